@@ -176,6 +176,21 @@ func (bitArray *BitArray) Or(other *BitArray) *BitArray {
 	return result
 }
 
+// Bytes packs the bits, the spare bits of the last byte are set to zero.
+// It's the inverse of NewFromBytes.
+func (bitArray *BitArray) Bytes() []byte {
+	length := bitArray.Len()
+	bytes := make([]byte, (length+7)/8)
+
+	for i := 0; i < length; i++ {
+		if bitArray.bits[i] {
+			bytes[i/8] |= byte(1) << byte(7-i%8)
+		}
+	}
+
+	return bytes
+}
+
 func (bitArray *BitArray) String() string {
 	var buffer bytes.Buffer
 
@@ -198,3 +198,27 @@ func TestStringConstructor(t *testing.T) {
 		t.Errorf("NewFromString(01010101011111).String() == %v, want %v", value, expected)
 	}
 }
+
+func TestBytes(t *testing.T) {
+	ba := NewFromString("101010100101010110")
+	expected := []byte{0xaa, 0x55, 0x80}
+	value := ba.Bytes()
+
+	if len(value) != len(expected) {
+		t.Fatalf("len(ba.Bytes()) == %v, want %v", len(value), len(expected))
+	}
+
+	for i, e := range expected {
+		if value[i] != e {
+			t.Errorf("ba.Bytes()[%v] == %x, want %x", i, value[i], e)
+		}
+	}
+
+	{
+		expected := ba.String()
+		value := NewFromBytes(ba.Bytes(), ba.Len()).String()
+		if value != expected {
+			t.Errorf("NewFromBytes(ba.Bytes()).String() == %v, want %v", value, expected)
+		}
+	}
+}
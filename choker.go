@@ -0,0 +1,115 @@
+package gotorrent
+
+import (
+	log "code.google.com/p/tcgl/applog"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// ChokeInterval is how often the choker reconsiders which peers to unchoke
+	ChokeInterval = 10 * time.Second
+	// OptimisticUnchokeRounds is the number of choke rounds between two optimistic unchokes
+	OptimisticUnchokeRounds = 3
+	DefaultUploadSlots      = 4
+)
+
+// Choker implements the tit-for-tat algorithm described in BEP 3.
+// The best uploadSlots-1 interested peers are unchoked, the remaining slot
+// is given to a randomly chosen peer which is rotated every 30 seconds.
+type Choker struct {
+	optimistic *Peer
+	rounds     int
+}
+
+func NewChoker() *Choker {
+	return new(Choker)
+}
+
+// Choke runs a choke round, seeding tells whether to rank peers by upload
+// rather than download rate.
+func (c *Choker) Choke(peers map[string]*Peer, uploadSlots int, seeding bool) {
+	candidates := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Id != "" && peer.IsInterested {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	// Snubbed peers are sorted last, they can only get the optimistic slot
+	sort.Sort(byRate{candidates, seeding})
+
+	regularSlots := uploadSlots - 1
+	if regularSlots < 0 {
+		regularSlots = 0
+	}
+	if regularSlots > len(candidates) {
+		regularSlots = len(candidates)
+	}
+
+	for i, peer := range candidates[:regularSlots] {
+		if !seeding && peer.IsSnubbed {
+			regularSlots = i
+			break
+		}
+	}
+
+	unchoke := make(map[*Peer]bool)
+	for _, peer := range candidates[:regularSlots] {
+		unchoke[peer] = true
+	}
+
+	// The optimistic peer may have disconnected, or lost interest, since the last round
+	if c.optimistic != nil {
+		optimistic := c.optimistic
+		c.optimistic = nil
+		for _, peer := range candidates {
+			if peer == optimistic {
+				c.optimistic = optimistic
+				break
+			}
+		}
+	}
+
+	if c.rounds%OptimisticUnchokeRounds == 0 || c.optimistic == nil || unchoke[c.optimistic] {
+		c.optimistic = nil
+		if rest := candidates[regularSlots:]; len(rest) > 0 && uploadSlots > 0 {
+			c.optimistic = rest[rand.Intn(len(rest))]
+			log.Debugf("Peer %v - Optimistic unchoke", c.optimistic.String())
+		}
+	}
+	c.rounds++
+
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, peer := range peers {
+		if unchoke[peer] {
+			if peer.AmChoking {
+				peer.SendUnchoke()
+			}
+		} else if !peer.AmChoking {
+			peer.SendChoke()
+		}
+	}
+}
+
+// byRate sorts peers from the fastest to the slowest.
+type byRate struct {
+	peers   []*Peer
+	seeding bool
+}
+
+func (s byRate) Len() int      { return len(s.peers) }
+func (s byRate) Swap(i, j int) { s.peers[i], s.peers[j] = s.peers[j], s.peers[i] }
+func (s byRate) Less(i, j int) bool {
+	if !s.seeding && s.peers[i].IsSnubbed != s.peers[j].IsSnubbed {
+		return s.peers[j].IsSnubbed
+	}
+	if s.seeding {
+		return s.peers[i].UploadRate.Rate() > s.peers[j].UploadRate.Rate()
+	}
+	return s.peers[i].DownloadRate.Rate() > s.peers[j].DownloadRate.Rate()
+}
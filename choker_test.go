@@ -0,0 +1,66 @@
+package gotorrent
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestChokeSnubbed(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+	pm := torrent.PeerManager
+
+	// From the fastest to the slowest, the fastest is snubbing us
+	var peers []*Peer
+	for i, addr := range []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881", "10.0.0.4:6881"} {
+		peer := newTestPeer(pm, addr)
+		peer.IsInterested = true
+		peer.DownloadRate.Add((4 - i) * MaxBlockLength * RateWindow)
+		peers = append(peers, peer)
+	}
+	snubbed := peers[0]
+	snubbed.IsSnubbed = true
+
+	{
+		sorted := append([]*Peer(nil), peers...)
+		sort.Sort(byRate{sorted, false})
+		if last := sorted[len(sorted)-1]; last != snubbed {
+			t.Errorf("Sorted last: %v, want the snubbed peer %v", last.String(), snubbed.String())
+		}
+	}
+
+	// Only the optimistic slot is left for the snubbed peer
+	pm.choker.Choke(pm.Peers, 3, false)
+	if peers[1].AmChoking || peers[2].AmChoking {
+		t.Errorf("The fastest peers which don't snub us are choked")
+	}
+	if !snubbed.AmChoking == !peers[3].AmChoking {
+		t.Errorf("Optimistic unchoke: snubbed peer choked == %v, slowest peer choked == %v, want a single one unchoked",
+			snubbed.AmChoking, peers[3].AmChoking)
+	}
+}
+
+func TestOptimisticUnchoke(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+	pm := torrent.PeerManager
+
+	first, second := newTestPeer(pm, "10.0.0.1:6881"), newTestPeer(pm, "10.0.0.2:6881")
+	first.IsInterested = true
+	second.IsInterested = true
+
+	// A single slot, which is the optimistic one
+	pm.choker.Choke(pm.Peers, 1, false)
+	optimistic, other := first, second
+	if first.AmChoking {
+		optimistic, other = second, first
+	}
+	if optimistic.AmChoking || !other.AmChoking {
+		t.Fatalf("%v and %v unchoked, want a single peer", first.String(), second.String())
+	}
+
+	// The slot is given to somebody else as soon as the peer isn't interested
+	optimistic.IsInterested = false
+	pm.choker.Choke(pm.Peers, 1, false)
+	if !optimistic.AmChoking || other.AmChoking {
+		t.Errorf("Peer %v still unchoked after losing interest, want %v", optimistic.String(), other.String())
+	}
+}
@@ -1,7 +1,15 @@
 package gotorrent
 
 import (
-//log "code.google.com/p/tcgl/applog"
+	log "code.google.com/p/tcgl/applog"
+	"fmt"
+	"github.com/moretti/gotorrent/dht"
+	"github.com/moretti/gotorrent/ipfilter"
+	"github.com/moretti/gotorrent/mse"
+	"github.com/moretti/gotorrent/utp"
+	"net"
+	"sync"
+	"time"
 )
 
 type Client struct {
@@ -9,6 +17,39 @@ type Client struct {
 	Torrents     []*Torrent
 	DownloadPath string
 	Port         int
+	UploadSlots  int
+	PeerTimeout  time.Duration
+	// MaxTorrentConnections bounds the peers of each torrent,
+	// Limiter the connections of all of them
+	MaxTorrentConnections int
+	Limiter               *ConnectionLimiter
+	// Encryption tells whether the peer connections use Message Stream Encryption
+	Encryption mse.Policy
+
+	// EnableUTP accepts uTP connections on the UDP Port and dials them
+	// before falling back to TCP
+	EnableUTP bool
+	UTP       []*utp.Socket
+	// IPv6 is our address reported to the trackers, it's looked up on
+	// the network interfaces when listening on IPv6 if unset
+	IPv6 net.IP
+
+	// EnableDHT starts a DHT node on DHTPort when listening, the UDP Port
+	// being taken by uTP, its routing table is saved to DHTStatePath
+	EnableDHT    bool
+	DHTPort      int
+	DHTStatePath string
+	DHT          *dht.DHT
+	// IPFilter blocks the connections from and to the ranges of a blocklist,
+	// the torrents share it, see LoadBlocklist
+	IPFilter       *ipfilter.Filter
+	watchBlocklist sync.Once
+	// EnableLSD announces the torrents on the local network
+	EnableLSD bool
+	LSD       *LocalDiscovery
+
+	listeners    []net.Listener
+	torrentsLock sync.Mutex
 }
 
 func NewClient() *Client {
@@ -19,22 +60,267 @@ func NewClient() *Client {
 	// TODO: Read these options from the command line
 	c.Port = 6881
 	c.DownloadPath = "."
+	c.UploadSlots = DefaultUploadSlots
+	c.PeerTimeout = DefaultPeerTimeout
+	c.MaxTorrentConnections = DefaultMaxTorrentConnections
+	c.Limiter = NewConnectionLimiter(DefaultMaxConnections, DefaultMaxHalfOpen)
+	c.Encryption = mse.Preferred
+	c.EnableUTP = true
+	c.EnableDHT = true
+	c.DHTPort = 6882
+	c.DHTStatePath = "dht.dat"
+	c.EnableLSD = true
+	c.IPFilter = ipfilter.New(nil)
 
 	return c
 }
 
-func (client *Client) AddTorrent(path string) *Torrent {
-	torrent := NewTorrent(
+// AddTorrent starts downloading a .torrent file or a magnet link.
+func (client *Client) AddTorrent(path string) (torrent *Torrent, err error) {
+	torrent, err = NewTorrent(
 		client.Id,
 		client.Port,
 		path,
 		client.DownloadPath,
+		client.Limiter,
 	)
+	if err != nil {
+		return
+	}
+	torrent.UploadSlots = client.UploadSlots
+	torrent.PeerTimeout = client.PeerTimeout
+	torrent.MaxConnections = client.MaxTorrentConnections
+	torrent.Encryption = client.Encryption
+	torrent.DHT = client.DHT
+	torrent.IPFilter = client.IPFilter
+	torrent.IPv6 = client.IPv6
+	if len(client.UTP) > 0 {
+		torrent.UTP = client.UTP
+		torrent.DialPolicy = DialUTPThenTCP
+	}
+	torrent.PeerManager.Start()
 
+	client.torrentsLock.Lock()
 	client.Torrents = append(client.Torrents, torrent)
-	return torrent
+	client.torrentsLock.Unlock()
+
+	if client.LSD != nil {
+		go client.LSD.Announce(torrent)
+	}
+	return
 }
 
 func (client *Client) RemoveTorrent(torrent Torrent) {
 	panic("Not implemented")
 }
+
+// Listen accepts incoming peer connections on client.Port, over TCP and uTP,
+// for both IPv4 and IPv6. Every connection is routed, after the handshake,
+// to the torrent with the same info hash.
+func (client *Client) Listen() (err error) {
+	// The address families have their own sockets, an IPv6 socket
+	// doesn't accept IPv4 connections on every system
+	addr := fmt.Sprintf(":%v", client.Port)
+	for _, network := range []string{"tcp4", "tcp6"} {
+		listener, listenErr := net.Listen(network, addr)
+		if listenErr != nil {
+			log.Errorf("Unable to listen on %v: %v", network, listenErr)
+			err = listenErr
+			continue
+		}
+
+		log.Debugf("Listening on %v", listener.Addr())
+		client.listeners = append(client.listeners, listener)
+		go client.accept(listener)
+	}
+	if len(client.listeners) == 0 {
+		return
+	}
+	err = nil
+
+	if client.EnableUTP {
+		for _, network := range []string{"udp4", "udp6"} {
+			socket, listenErr := utp.Listen(network, addr)
+			if listenErr != nil {
+				log.Errorf("Unable to listen on %v: %v", network, listenErr)
+				continue
+			}
+
+			log.Debugf("Listening on %v over uTP", socket.Addr())
+			client.UTP = append(client.UTP, socket)
+			go client.accept(socket)
+		}
+	}
+
+	if client.IPv6 == nil && client.listensOnIPv6() {
+		client.IPv6 = globalIPv6()
+	}
+
+	if client.EnableDHT {
+		client.DHT, err = dht.New(dht.Config{
+			Port:           client.DHTPort,
+			BootstrapNodes: dht.DefaultBootstrapNodes,
+			StatePath:      client.DHTStatePath,
+		})
+		if err != nil {
+			client.closeListeners()
+			return
+		}
+		client.DHT.Start()
+	}
+
+	if client.EnableLSD {
+		// Multicast may not be available, the torrents still work without it
+		if client.LSD, err = NewLocalDiscovery(client); err != nil {
+			log.Errorf("Unable to start the local service discovery: %v", err)
+			client.LSD, err = nil, nil
+		} else {
+			client.LSD.Start()
+		}
+	}
+	return
+}
+
+// LoadBlocklist reads a blocklist in the ipfilter.dat, P2P or CIDR format,
+// it replaces the previous one and is reloaded whenever the file changes.
+func (client *Client) LoadBlocklist(path string) (err error) {
+	if err = client.IPFilter.Open(path); err != nil {
+		return
+	}
+
+	log.Debugf("Blocklist %v - %v ranges, %v invalid lines skipped", path, client.IPFilter.Len(), client.IPFilter.Skipped())
+	client.watchBlocklist.Do(func() {
+		client.IPFilter.Watch(ipfilter.ReloadInterval, func(err error) {
+			log.Errorf("Unable to reload the blocklist: %v", err)
+		})
+	})
+	return
+}
+
+func (client *Client) Close() (err error) {
+	if client.IPFilter != nil {
+		client.IPFilter.Close()
+	}
+	if client.DHT != nil {
+		client.DHT.Close()
+	}
+	if client.LSD != nil {
+		client.LSD.Close()
+	}
+	return client.closeListeners()
+}
+
+func (client *Client) closeListeners() (err error) {
+	for _, socket := range client.UTP {
+		socket.Close()
+	}
+	for _, listener := range client.listeners {
+		if closeErr := listener.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	client.UTP, client.listeners = nil, nil
+	return
+}
+
+func (client *Client) listensOnIPv6() bool {
+	for _, listener := range client.listeners {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// globalIPv6 returns the first global unicast IPv6 address of the network
+// interfaces, nil if there are none.
+func globalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		// Unique local addresses, fc00::/7, aren't reachable from the Internet
+		if ipNet.IP[0]&0xfe == 0xfc {
+			continue
+		}
+		return ipNet.IP
+	}
+	return nil
+}
+
+func (client *Client) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Errorf("Unable to accept a connection: %v", err)
+			return
+		}
+
+		go client.handleConn(conn)
+	}
+}
+
+func (client *Client) handleConn(plainConn net.Conn) {
+	if addr := tcpAddr(plainConn.RemoteAddr()); client.IPFilter != nil && client.IPFilter.Blocked(addr.IP) {
+		log.Debugf("Peer %v - Blocked", addr.String())
+		plainConn.Close()
+		return
+	}
+
+	conn, err := mse.Accept(plainConn, client.infoHashes(), client.Encryption)
+	if err != nil {
+		log.Debugf("Peer %v - Unable to negotiate the encryption: %v", plainConn.RemoteAddr(), err)
+		plainConn.Close()
+		return
+	}
+
+	hand, err := readHandshake(conn)
+	if err != nil {
+		log.Debugf("Peer %v - Unable to read the handshake: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	torrent := client.findTorrent(string(hand.InfoHash[:]))
+	if torrent == nil {
+		log.Debugf("Peer %v - Unknown info hash: %x", conn.RemoteAddr(), hand.InfoHash)
+		conn.Close()
+		return
+	}
+
+	if err = checkHandshake(hand, torrent.InfoHash); err != nil {
+		log.Debugf("Peer %v - Invalid handshake: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	torrent.PeerManager.AddPeerConn <- IncomingPeer{Conn: conn, Handshake: *hand}
+}
+
+func (client *Client) infoHashes() (infoHashes []string) {
+	client.torrentsLock.Lock()
+	defer client.torrentsLock.Unlock()
+
+	for _, torrent := range client.Torrents {
+		infoHashes = append(infoHashes, torrent.InfoHash)
+	}
+	return
+}
+
+func (client *Client) findTorrent(infoHash string) *Torrent {
+	client.torrentsLock.Lock()
+	defer client.torrentsLock.Unlock()
+
+	for _, torrent := range client.Torrents {
+		if torrent.InfoHash == infoHash {
+			return torrent
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package gotorrent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := NewClient()
+	defer client.Close()
+
+	torrent, err := client.AddTorrent("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if err != nil {
+		t.Fatalf("AddTorrent() returned %v", err)
+	}
+
+	first, second := net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8")
+	for _, test := range []struct {
+		blocklist string
+		blocked   net.IP
+		allowed   net.IP
+	}{
+		{"First:1.2.3.0-1.2.3.255\n", first, second},
+		// The torrents added before see the new blocklist
+		{"Second:5.6.7.0-5.6.7.255\n", second, first},
+	} {
+		path := filepath.Join(dir, "blocklist.p2p")
+		ioutil.WriteFile(path, []byte(test.blocklist), 0644)
+		if err = client.LoadBlocklist(path); err != nil {
+			t.Fatalf("LoadBlocklist() returned %v", err)
+		}
+
+		if !torrent.IsBlocked(test.blocked) || torrent.IsBlocked(test.allowed) {
+			t.Errorf("IsBlocked(%v) == %v, IsBlocked(%v) == %v, want true, false",
+				test.blocked, torrent.IsBlocked(test.blocked), test.allowed, torrent.IsBlocked(test.allowed))
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package gotorrent
+
+import (
+	log "code.google.com/p/tcgl/applog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxConnections bounds the connections of all the torrents
+	DefaultMaxConnections = 200
+	// DefaultMaxTorrentConnections bounds the connections of a torrent
+	DefaultMaxTorrentConnections = 50
+	// DefaultMaxHalfOpen bounds the outgoing connections not established yet,
+	// many routers and firewalls don't cope with hundreds of them
+	DefaultMaxHalfOpen = 16
+
+	// MaxCandidates bounds the addresses known for a torrent
+	MaxCandidates = 1000
+	// ReconnectBackoff is the delay before reconnecting to a peer, it's
+	// doubled after each failure up to MaxReconnectBackoff
+	ReconnectBackoff    = 30 * time.Second
+	MaxReconnectBackoff = 30 * time.Minute
+	// MaxPeerFailures is the number of consecutive failures after which
+	// a peer is forgotten, until a source reports it again
+	MaxPeerFailures = 6
+)
+
+// PeerSource tells where a peer has been found, a peer can have several sources.
+type PeerSource int
+
+const (
+	SourceTracker PeerSource = 1 << iota
+	SourceDHT
+	SourcePEX
+	SourceLSD
+	SourceIncoming
+)
+
+func (source PeerSource) String() string {
+	var names []string
+	for _, s := range []struct {
+		source PeerSource
+		name   string
+	}{
+		{SourceTracker, "tracker"},
+		{SourceDHT, "dht"},
+		{SourcePEX, "pex"},
+		{SourceLSD, "lsd"},
+		{SourceIncoming, "incoming"},
+	} {
+		if source&s.source != 0 {
+			names = append(names, s.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// PeerAddr is the address of a peer found by one of the sources.
+type PeerAddr struct {
+	Addr   net.TCPAddr
+	Source PeerSource
+}
+
+// candidate is a known address we may connect to.
+type candidate struct {
+	addr    net.TCPAddr
+	source  PeerSource
+	peer    *Peer
+	retryAt time.Time
+	// failures is the number of connections lost since the last successful handshake
+	failures int
+}
+
+// ConnectionLimiter enforces the limits shared by the torrents of a client.
+type ConnectionLimiter struct {
+	MaxConnections int
+	MaxHalfOpen    int
+
+	lock        sync.Mutex
+	connections int
+	halfOpen    int
+}
+
+func NewConnectionLimiter(maxConnections, maxHalfOpen int) *ConnectionLimiter {
+	l := new(ConnectionLimiter)
+	l.MaxConnections = maxConnections
+	l.MaxHalfOpen = maxHalfOpen
+	return l
+}
+
+// ReserveDial counts an outgoing connection, it returns false if we
+// are connected to too many peers or waiting for too many of them.
+func (l *ConnectionLimiter) ReserveDial() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.connections >= l.MaxConnections || l.halfOpen >= l.MaxHalfOpen {
+		return false
+	}
+	l.connections++
+	l.halfOpen++
+	return true
+}
+
+// DialDone tells that an outgoing connection has been established or has failed.
+func (l *ConnectionLimiter) DialDone(established bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.halfOpen--
+	if !established {
+		l.connections--
+	}
+}
+
+// ReserveIncoming counts an accepted connection, it returns false if
+// we are connected to too many peers.
+func (l *ConnectionLimiter) ReserveIncoming() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.connections >= l.MaxConnections {
+		return false
+	}
+	l.connections++
+	return true
+}
+
+// Release forgets an established connection.
+func (l *ConnectionLimiter) Release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.connections--
+}
+
+// Counts returns the number of connections, half open ones included.
+func (l *ConnectionLimiter) Counts() (connections, halfOpen int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.connections, l.halfOpen
+}
+
+// addPeer adds an address to the candidates, the peers are connected
+// to as the limits allow.
+func (pm *PeerManager) addPeer(peerAddr net.TCPAddr, source PeerSource) {
+	strAddr := peerAddr.String()
+	if c, ok := pm.candidates[strAddr]; ok {
+		c.source |= source
+		return
+	}
+	if peer, ok := pm.Peers[strAddr]; ok {
+		peer.Source |= source
+		return
+	}
+	if pm.Torrent.IsBlocked(peerAddr.IP) {
+		log.Debugf("Peer %v - Blocked", peerAddr.String())
+		return
+	}
+	if len(pm.candidates) >= MaxCandidates {
+		return
+	}
+
+	log.Debugf("Found Peer: %v (%v)", peerAddr, source)
+	pm.candidates[strAddr] = &candidate{addr: peerAddr, source: source}
+	pm.connectPeers(time.Now())
+}
+
+// connectPeers dials the candidates, those which have failed least first.
+func (pm *PeerManager) connectPeers(now time.Time) {
+	for len(pm.Peers) < pm.Torrent.MaxConnections {
+		var next *candidate
+		for _, c := range pm.candidates {
+			if c.peer == nil && !now.Before(c.retryAt) && (next == nil || c.failures < next.failures) {
+				next = c
+			}
+		}
+		if next == nil {
+			return
+		}
+		// The blocklist may have been reloaded since the address was added
+		if pm.Torrent.IsBlocked(next.addr.IP) {
+			delete(pm.candidates, next.addr.String())
+			continue
+		}
+		if !pm.Torrent.Limiter.ReserveDial() {
+			return
+		}
+
+		peer := NewPeer(
+			next.addr,
+			pm.Torrent,
+			pm.Errors,
+			pm.InMessages,
+			pm.InHandshakes)
+		peer.Source = next.source
+		peer.halfOpen = true
+		next.peer = peer
+
+		pm.Peers[peer.String()] = peer
+		peer.Connect()
+	}
+}
+
+// peerConnected records that the handshake of an outgoing connection has been received.
+func (pm *PeerManager) peerConnected(peer *Peer) {
+	if peer.halfOpen {
+		peer.halfOpen = false
+		pm.Torrent.Limiter.DialDone(true)
+	}
+	if c, ok := pm.candidates[peer.String()]; ok && c.peer == peer {
+		c.failures = 0
+	}
+}
+
+// removePeer closes the connection and frees its slot, the address is
+// retried later unless forget is true.
+func (pm *PeerManager) removePeer(peer *Peer, forget bool) {
+	strAddr := peer.String()
+	if pm.Peers[strAddr] != peer {
+		return
+	}
+
+	delete(pm.Peers, strAddr)
+	peer.Close()
+	pm.picker.RemoveBitField(peer.BitField())
+	pm.releaseBlocks(peer, peer.ReleaseBlocks())
+
+	if peer.halfOpen {
+		pm.dialFailed(peer)
+	} else {
+		pm.Torrent.Limiter.Release()
+	}
+
+	if c, ok := pm.candidates[strAddr]; ok && c.peer == peer {
+		c.peer = nil
+		c.failures++
+		if forget || c.failures >= MaxPeerFailures {
+			delete(pm.candidates, strAddr)
+		} else {
+			c.retryAt = time.Now().Add(reconnectBackoff(c.failures))
+		}
+	}
+}
+
+// dialFailed frees the half open slot of a dropped peer once its dial has
+// returned, a dial still in progress may succeed and exceed the limits.
+func (pm *PeerManager) dialFailed(peer *Peer) {
+	limiter := pm.Torrent.Limiter
+	select {
+	case <-peer.connection.Dialed():
+		limiter.DialDone(false)
+	default:
+		go func() {
+			<-peer.connection.Dialed()
+			limiter.DialDone(false)
+		}()
+	}
+}
+
+// reconnectBackoff returns the delay before the next connection to a peer.
+func reconnectBackoff(failures int) time.Duration {
+	backoff := ReconnectBackoff
+	for i := 1; i < failures && backoff < MaxReconnectBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxReconnectBackoff {
+		backoff = MaxReconnectBackoff
+	}
+	return backoff
+}
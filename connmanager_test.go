@@ -0,0 +1,171 @@
+package gotorrent
+
+import (
+	"github.com/moretti/gotorrent/mse"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	l := NewConnectionLimiter(3, 2)
+
+	if !l.ReserveDial() || !l.ReserveDial() {
+		t.Fatalf("ReserveDial() == false, want true")
+	}
+	// Too many half open connections
+	if l.ReserveDial() {
+		t.Errorf("ReserveDial() == true with %v half open connections, want false", l.MaxHalfOpen)
+	}
+
+	l.DialDone(true)
+	l.DialDone(false)
+	if !l.ReserveIncoming() || !l.ReserveDial() {
+		t.Fatalf("Reserve() == false, want true")
+	}
+	// Too many connections
+	if l.ReserveIncoming() {
+		t.Errorf("ReserveIncoming() == true with %v connections, want false", l.MaxConnections)
+	}
+
+	{
+		connections, halfOpen := l.Counts()
+		if connections != 3 || halfOpen != 1 {
+			t.Errorf("Counts() == %v, %v, want 3, 1", connections, halfOpen)
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, ReconnectBackoff},
+		{2, 2 * ReconnectBackoff},
+		{4, 8 * ReconnectBackoff},
+		{20, MaxReconnectBackoff},
+	}
+
+	for _, test := range tests {
+		if value := reconnectBackoff(test.failures); value != test.expected {
+			t.Errorf("reconnectBackoff(%v) == %v, want %v", test.failures, value, test.expected)
+		}
+	}
+
+	{
+		expected := "tracker|pex"
+		value := (SourceTracker | SourcePEX).String()
+		if value != expected {
+			t.Errorf("PeerSource.String() == %v, want %v", value, expected)
+		}
+	}
+}
+
+// closedAddr returns a local address nobody listens on, dialing it fails at once.
+func closedAddr(t *testing.T) net.TCPAddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return *listener.Addr().(*net.TCPAddr)
+}
+
+func TestConnectPeers(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 4*MaxBlockLength), MaxBlockLength)
+	torrent.Limiter = NewConnectionLimiter(DefaultMaxConnections, 1)
+	torrent.Encryption = mse.Disabled
+	pm := torrent.PeerManager
+
+	fresh, failed, later := closedAddr(t), closedAddr(t), closedAddr(t)
+	now := time.Now()
+	pm.candidates[failed.String()] = &candidate{addr: failed, source: SourceTracker, failures: 2}
+	pm.candidates[later.String()] = &candidate{addr: later, source: SourceTracker, retryAt: now.Add(time.Minute)}
+	pm.addPeer(fresh, SourceDHT)
+
+	// The candidates which have failed least are dialed first, as many as the half open limit allows
+	if _, ok := pm.Peers[fresh.String()]; !ok || len(pm.Peers) != 1 {
+		t.Fatalf("Peers == %v, want %v", pm.Peers, fresh.String())
+	}
+
+	waitError := func() {
+		select {
+		case peerError := <-pm.Errors:
+			pm.handleError(peerError)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The dial hasn't failed")
+		}
+	}
+
+	// The failure frees the half open slot for the next candidate
+	waitError()
+	if _, ok := pm.Peers[failed.String()]; !ok || len(pm.Peers) != 1 {
+		t.Fatalf("Peers == %v, want %v", pm.Peers, failed.String())
+	}
+	waitError()
+
+	if connections, halfOpen := torrent.Limiter.Counts(); connections != 0 || halfOpen != 0 {
+		t.Errorf("Counts() == %v, %v after the failures, want 0, 0", connections, halfOpen)
+	}
+
+	{
+		c := pm.candidates[fresh.String()]
+		if c.failures != 1 || c.peer != nil || c.retryAt.Sub(now) < ReconnectBackoff {
+			t.Errorf("Candidate %v: %v failures, retry in %v, want 1 failure, retry in %v",
+				fresh.String(), c.failures, c.retryAt.Sub(now), ReconnectBackoff)
+		}
+		c = pm.candidates[failed.String()]
+		if c.failures != 3 || c.retryAt.Sub(now) < reconnectBackoff(3) {
+			t.Errorf("Candidate %v: %v failures, retry in %v, want 3 failures, retry in %v",
+				failed.String(), c.failures, c.retryAt.Sub(now), reconnectBackoff(3))
+		}
+	}
+
+	// Nobody is retried before its backoff
+	pm.connectPeers(now.Add(ReconnectBackoff / 2))
+	if len(pm.Peers) != 0 {
+		t.Errorf("Peers == %v before the backoff, want none", pm.Peers)
+	}
+
+	// A peer failing too often is forgotten
+	pm.candidates[fresh.String()].failures = MaxPeerFailures - 1
+	pm.connectPeers(time.Now().Add(ReconnectBackoff))
+	waitError()
+	if _, ok := pm.candidates[fresh.String()]; ok {
+		t.Errorf("Candidate %v kept after %v failures", fresh.String(), MaxPeerFailures)
+	}
+	for _, peer := range pm.Peers {
+		peer.Close()
+	}
+}
+
+func TestDropWhileDialing(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+	torrent.Encryption = mse.Disabled
+	pm := torrent.PeerManager
+
+	if !torrent.Limiter.ReserveDial() {
+		t.Fatalf("ReserveDial() == false, want true")
+	}
+	peer := NewPeer(closedAddr(t), torrent, pm.Errors, pm.InMessages, pm.InHandshakes)
+	peer.halfOpen = true
+	pm.Peers[peer.String()] = peer
+
+	// The slot is kept until the dial returns
+	pm.dropPeer(peer)
+	if connections, halfOpen := torrent.Limiter.Counts(); connections != 1 || halfOpen != 1 {
+		t.Errorf("Counts() == %v, %v while dialing, want 1, 1", connections, halfOpen)
+	}
+
+	peer.connection.Connect()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		connections, halfOpen := torrent.Limiter.Counts()
+		if connections == 0 && halfOpen == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Counts() == %v, %v after the dial, want 0, 0", connections, halfOpen)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+// Package dht implements a node of the Mainline DHT, described in BEP 5.
+package dht
+
+import (
+	log "code.google.com/p/tcgl/applog"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Alpha is the number of queries a lookup sends in parallel
+	Alpha = 3
+	// QueryTimeout is how long we wait for the response to a query
+	QueryTimeout = 2 * time.Second
+	// MaintenanceInterval is how often the buckets are refreshed and the peers expired
+	MaintenanceInterval = time.Minute
+	// TokenRotation is how often the secret of the tokens changes
+	TokenRotation = 5 * time.Minute
+	// PeerExpiry is how long an announced peer is kept
+	PeerExpiry = 30 * time.Minute
+	// MaxPeersPerResponse bounds the "values" of a get_peers response
+	MaxPeersPerResponse = 50
+	// MaxPacketSize is the largest datagram we read
+	MaxPacketSize = 8192
+)
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var (
+	ErrTimeout = errors.New("Query timed out")
+	ErrClosed  = errors.New("DHT closed")
+)
+
+type Config struct {
+	Port           int
+	BootstrapNodes []string
+	// StatePath is where the routing table is saved, empty to disable persistence
+	StatePath string
+}
+
+type DHT struct {
+	Id     NodeId
+	config Config
+	conn   *net.UDPConn
+	table  *RoutingTable
+	tokens *tokenManager
+
+	// Peers announced to us, by info hash and address
+	peers     map[string]map[string]announcedPeer
+	peersLock sync.Mutex
+
+	transactions     map[string]*transaction
+	nextTransaction  uint16
+	transactionsLock sync.Mutex
+
+	// Nodes of the previous session, pinged when bootstrapping
+	savedNodes []*Node
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type announcedPeer struct {
+	addr      net.TCPAddr
+	announced time.Time
+}
+
+type transaction struct {
+	addr     *net.UDPAddr
+	response chan *Message
+}
+
+// New creates a node listening on config.Port, its id and routing table
+// are restored from config.StatePath if possible.
+func New(config Config) (d *DHT, err error) {
+	d = new(DHT)
+	d.config = config
+	d.Id = NewNodeId()
+	d.tokens = newTokenManager()
+	d.peers = make(map[string]map[string]announcedPeer)
+	d.transactions = make(map[string]*transaction)
+	d.done = make(chan struct{})
+
+	if config.StatePath != "" {
+		if id, nodes, err := LoadRoutingTable(config.StatePath); err == nil {
+			log.Debugf("DHT - Loaded %v nodes from %v", len(nodes), config.StatePath)
+			d.Id = id
+			d.savedNodes = nodes
+		}
+	}
+	d.table = NewRoutingTable(d.Id)
+
+	d.conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: config.Port})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Start serves the queries of the other nodes and joins the network.
+func (d *DHT) Start() {
+	go d.read()
+	go d.maintain()
+	go d.Bootstrap()
+}
+
+func (d *DHT) Close() (err error) {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		if d.config.StatePath != "" && d.table.Len() > 0 {
+			if err := d.table.Save(d.config.StatePath); err != nil {
+				log.Errorf("DHT - Unable to save the routing table: %v", err)
+			}
+		}
+		err = d.conn.Close()
+	})
+	return
+}
+
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the number of nodes in the routing table.
+func (d *DHT) Nodes() int {
+	return d.table.Len()
+}
+
+// Bootstrap pings the nodes of the previous session and the bootstrap nodes,
+// then looks up our own id to fill the routing table.
+func (d *DHT) Bootstrap() {
+	var wg sync.WaitGroup
+	ping := func(addr *net.UDPAddr) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Ping(addr)
+		}()
+	}
+
+	for _, node := range d.savedNodes {
+		ping(node.Addr)
+	}
+	for _, hostPort := range d.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", hostPort)
+		if err != nil {
+			log.Debugf("DHT - Unable to resolve %v: %v", hostPort, err)
+			continue
+		}
+		ping(addr)
+	}
+	wg.Wait()
+
+	d.lookup(d.Id, false)
+	log.Debugf("DHT - Bootstrapped, %v nodes", d.table.Len())
+}
+
+// AddNode pings a node, it's added to the routing table if it answers.
+func (d *DHT) AddNode(addr *net.UDPAddr) {
+	go d.Ping(addr)
+}
+
+func (d *DHT) Ping(addr *net.UDPAddr) error {
+	_, err := d.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// GetPeers looks for the peers downloading a torrent.
+func (d *DHT) GetPeers(infoHash string) []net.TCPAddr {
+	_, peers := d.lookup(NodeId(infoHash), true)
+	return peers
+}
+
+// Announce looks for the peers downloading a torrent, and tells the closest
+// nodes to the info hash that we accept connections for it on port.
+func (d *DHT) Announce(infoHash string, port int) []net.TCPAddr {
+	closest, peers := d.lookup(NodeId(infoHash), true)
+
+	var wg sync.WaitGroup
+	for _, result := range closest {
+		if result.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *lookupNode) {
+			defer wg.Done()
+			d.query(result.node.Addr, "announce_peer", map[string]interface{}{
+				"info_hash": infoHash,
+				"port":      port,
+				"token":     result.token,
+			})
+		}(result)
+	}
+	wg.Wait()
+
+	return peers
+}
+
+// query sends a query and waits for its response.
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (response *Message, err error) {
+	args["id"] = string(d.Id)
+
+	t := &transaction{addr, make(chan *Message, 1)}
+	d.transactionsLock.Lock()
+	d.nextTransaction++
+	id := make([]byte, 2)
+	binary.BigEndian.PutUint16(id, d.nextTransaction)
+	d.transactions[string(id)] = t
+	d.transactionsLock.Unlock()
+
+	defer func() {
+		d.transactionsLock.Lock()
+		delete(d.transactions, string(id))
+		d.transactionsLock.Unlock()
+	}()
+
+	if err = d.send(addr, NewQuery(string(id), method, args)); err != nil {
+		return
+	}
+
+	timeout := time.NewTimer(QueryTimeout)
+	defer timeout.Stop()
+
+	select {
+	case response = <-t.response:
+	case <-timeout.C:
+		d.table.Failed(addr)
+		return nil, ErrTimeout
+	case <-d.done:
+		return nil, ErrClosed
+	}
+
+	if response.Type == ErrorType {
+		return nil, errors.New(response.ErrorMessage)
+	}
+
+	nodeId, ok := response.NodeId()
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+	d.table.Update(nodeId, addr, time.Now())
+	return
+}
+
+func (d *DHT) send(addr *net.UDPAddr, m *Message) error {
+	data, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (d *DHT) read() {
+	buffer := make([]byte, MaxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-d.done:
+			default:
+				log.Errorf("DHT - Unable to read: %v", err)
+			}
+			return
+		}
+
+		m, err := DecodeMessage(buffer[:n])
+		if err != nil {
+			log.Debugf("DHT - Invalid message from %v: %v", addr, err)
+			continue
+		}
+
+		if m.Type == QueryType {
+			d.handleQuery(m, addr)
+			continue
+		}
+
+		d.transactionsLock.Lock()
+		t, ok := d.transactions[m.TransactionId]
+		d.transactionsLock.Unlock()
+
+		// Responses are only accepted from the node which has been queried
+		if ok && t.addr.String() == addr.String() {
+			select {
+			case t.response <- m:
+			default:
+			}
+		}
+	}
+}
+
+func (d *DHT) handleQuery(m *Message, addr *net.UDPAddr) {
+	nodeId, ok := m.NodeId()
+	if !ok {
+		d.send(addr, NewError(m.TransactionId, ProtocolError, "Invalid id"))
+		return
+	}
+	d.table.Update(nodeId, addr, time.Now())
+
+	response := map[string]interface{}{"id": string(d.Id)}
+
+	switch m.Method {
+	case "ping":
+	case "find_node":
+		target := m.String("target")
+		if len(target) != NodeIdLength {
+			d.send(addr, NewError(m.TransactionId, ProtocolError, "Invalid target"))
+			return
+		}
+		response["nodes"] = encodeNodes(d.table.Closest(NodeId(target), K))
+	case "get_peers":
+		infoHash := m.String("info_hash")
+		if len(infoHash) != NodeIdLength {
+			d.send(addr, NewError(m.TransactionId, ProtocolError, "Invalid info_hash"))
+			return
+		}
+		response["token"] = d.tokens.Token(addr.IP)
+		response["nodes"] = encodeNodes(d.table.Closest(NodeId(infoHash), K))
+		if values := d.announcedPeers(infoHash); len(values) > 0 {
+			response["values"] = values
+		}
+	case "announce_peer":
+		infoHash := m.String("info_hash")
+		if len(infoHash) != NodeIdLength {
+			d.send(addr, NewError(m.TransactionId, ProtocolError, "Invalid info_hash"))
+			return
+		}
+		if !d.tokens.IsValid(m.String("token"), addr.IP) {
+			d.send(addr, NewError(m.TransactionId, ProtocolError, "Invalid token"))
+			return
+		}
+
+		port := m.Int("port")
+		if m.Int("implied_port") != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 0xFFFF {
+			d.send(addr, NewError(m.TransactionId, ProtocolError, "Invalid port"))
+			return
+		}
+		d.addAnnouncedPeer(infoHash, net.TCPAddr{IP: addr.IP, Port: port})
+	default:
+		d.send(addr, NewError(m.TransactionId, UnknownMethod, "Method Unknown"))
+		return
+	}
+
+	d.send(addr, NewResponse(m.TransactionId, response))
+}
+
+func (d *DHT) addAnnouncedPeer(infoHash string, addr net.TCPAddr) {
+	d.peersLock.Lock()
+	defer d.peersLock.Unlock()
+
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		peers = make(map[string]announcedPeer)
+		d.peers[infoHash] = peers
+	}
+	peers[addr.String()] = announcedPeer{addr, time.Now()}
+}
+
+// announcedPeers returns the compact addresses of the peers of a torrent.
+func (d *DHT) announcedPeers(infoHash string) (values []interface{}) {
+	d.peersLock.Lock()
+	defer d.peersLock.Unlock()
+
+	for _, peer := range d.peers[infoHash] {
+		if len(values) == MaxPeersPerResponse {
+			break
+		}
+		values = append(values, string(compactAddr(peer.addr.IP, peer.addr.Port)))
+	}
+	return
+}
+
+func (d *DHT) expirePeers(now time.Time) {
+	d.peersLock.Lock()
+	defer d.peersLock.Unlock()
+
+	for infoHash, peers := range d.peers {
+		for key, peer := range peers {
+			if now.Sub(peer.announced) > PeerExpiry {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, infoHash)
+		}
+	}
+}
+
+// maintain rotates the tokens, expires the announced peers
+// and refreshes the buckets nobody has been heard of lately.
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(MaintenanceInterval)
+	defer ticker.Stop()
+	lastRotation := time.Now()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if now.Sub(lastRotation) >= TokenRotation {
+				d.tokens.Rotate()
+				lastRotation = now
+			}
+			d.expirePeers(now)
+
+			for _, target := range d.table.StaleBuckets(now) {
+				d.lookup(target, false)
+			}
+
+			if d.table.Len() == 0 {
+				d.Bootstrap()
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// lookupNode is a node met during a lookup.
+type lookupNode struct {
+	node    *Node
+	token   string
+	queried bool
+	replied bool
+}
+
+// lookup runs an iterative lookup of target: the closest nodes we know are
+// queried, Alpha at a time, until the K closest nodes have all been queried.
+// It returns the K closest nodes which replied, with their token if getPeers is true.
+func (d *DHT) lookup(target NodeId, getPeers bool) (closest []*lookupNode, peers []net.TCPAddr) {
+	method, key := "find_node", "target"
+	if getPeers {
+		method, key = "get_peers", "info_hash"
+	}
+
+	var candidates []*lookupNode
+	seen := make(map[string]bool)
+	foundPeers := make(map[string]bool)
+	add := func(node *Node) {
+		if node.Id == d.Id || seen[node.Addr.String()] {
+			return
+		}
+		seen[node.Addr.String()] = true
+		candidates = append(candidates, &lookupNode{node: node})
+	}
+
+	for _, node := range d.table.Closest(target, K) {
+		add(node)
+	}
+
+	for {
+		sortLookupNodes(candidates, target)
+
+		// The nodes to query this round, among the K closest still candidates
+		var round []*lookupNode
+		considered := 0
+		for _, candidate := range candidates {
+			if considered == K || len(round) == Alpha {
+				break
+			}
+			if candidate.queried && !candidate.replied {
+				continue
+			}
+			considered++
+			if !candidate.queried {
+				round = append(round, candidate)
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		responses := make([]*Message, len(round))
+		var wg sync.WaitGroup
+		for i, candidate := range round {
+			candidate.queried = true
+			wg.Add(1)
+			go func(i int, candidate *lookupNode) {
+				defer wg.Done()
+				responses[i], _ = d.query(candidate.node.Addr, method, map[string]interface{}{key: string(target)})
+			}(i, candidate)
+		}
+		wg.Wait()
+
+		for i, response := range responses {
+			if response == nil {
+				continue
+			}
+			round[i].replied = true
+			round[i].token = response.String("token")
+
+			if nodes, err := decodeNodes(response.String("nodes")); err == nil {
+				for _, node := range nodes {
+					add(node)
+				}
+			}
+
+			values, _ := response.Args["values"].([]interface{})
+			for _, value := range values {
+				compact, _ := value.(string)
+				if addr := parseCompactAddr(compact); addr.Port != 0 && !foundPeers[addr.String()] {
+					foundPeers[addr.String()] = true
+					peers = append(peers, addr)
+				}
+			}
+		}
+
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+	}
+
+	for _, candidate := range candidates {
+		if len(closest) == K {
+			break
+		}
+		if candidate.replied {
+			closest = append(closest, candidate)
+		}
+	}
+	return
+}
+
+func sortLookupNodes(nodes []*lookupNode, target NodeId) {
+	// Insertion sort, the candidates are mostly sorted already
+	for i := 1; i < len(nodes); i++ {
+		for j := i; j > 0 && closer(target, nodes[j].node.Id, nodes[j-1].node.Id); j-- {
+			nodes[j], nodes[j-1] = nodes[j-1], nodes[j]
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	query := NewQuery("aa", "find_node", map[string]interface{}{"id": "abcdefghij0123456789", "target": "mnopqrstuvwxyz123456"})
+	data, err := query.Encode()
+	if err != nil {
+		t.Fatalf("query.Encode() returned %v", err)
+	}
+
+	{
+		expected := "d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe"
+		value := string(data)
+		if value != expected {
+			t.Errorf("query.Encode() == %v, want %v", value, expected)
+		}
+	}
+
+	m, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("DecodeMessage(%v) returned %v", string(data), err)
+	}
+	if m.TransactionId != "aa" || m.Type != QueryType || m.Method != "find_node" || m.String("target") != "mnopqrstuvwxyz123456" {
+		t.Errorf("DecodeMessage(%v) == %+v", string(data), m)
+	}
+
+	e, err := DecodeMessage([]byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"))
+	if err != nil || e.ErrorCode != GenericError || e.ErrorMessage != "A Generic Error Ocurred" {
+		t.Errorf("DecodeMessage(error) == %+v, %v", e, err)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := NewNodeId()
+	rt := NewRoutingTable(self)
+
+	for prefix := 0; prefix < 20; prefix++ {
+		id := randomIdInBucket(self, prefix)
+		if value := commonPrefixLen(self, id); value != prefix {
+			t.Errorf("commonPrefixLen(self, randomIdInBucket(self, %v)) == %v", prefix, value)
+		}
+	}
+
+	// Only K nodes fit in the farthest bucket
+	now := time.Now()
+	for i := 0; i < 2*K; i++ {
+		rt.Update(randomIdInBucket(self, 0), &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881}, now)
+	}
+	if value := rt.Len(); value != K {
+		t.Errorf("rt.Len() == %v, want %v", value, K)
+	}
+
+	target := NewNodeId()
+	closest := rt.Closest(target, K)
+	for i := 1; i < len(closest); i++ {
+		if closer(target, closest[i].Id, closest[i-1].Id) {
+			t.Errorf("rt.Closest() isn't sorted at %v", i)
+		}
+	}
+}
+
+func newTestNode(t *testing.T, bootstrap *DHT, statePath string) *DHT {
+	config := Config{StatePath: statePath}
+	if bootstrap != nil {
+		config.BootstrapNodes = []string{bootstrap.Addr().String()}
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New() returned %v", err)
+	}
+	d.conn.Close()
+	if d.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatalf("net.ListenUDP() returned %v", err)
+	}
+
+	go d.read()
+	d.Bootstrap()
+	return d
+}
+
+func TestLoopbackNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := newTestNode(t, nil, "")
+	defer first.Close()
+
+	nodes := []*DHT{first}
+	for i := 0; i < 4; i++ {
+		node := newTestNode(t, first, filepath.Join(dir, string('a'+rune(i))))
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+
+	for i, node := range nodes[1:] {
+		if node.Nodes() == 0 {
+			t.Errorf("nodes[%v].Nodes() == 0 after bootstrapping", i+1)
+		}
+	}
+
+	infoHash := string(NewNodeId())
+	nodes[1].Announce(infoHash, 6881)
+
+	peers := nodes[4].GetPeers(infoHash)
+	expected := "127.0.0.1:6881"
+	if len(peers) != 1 || peers[0].String() != expected {
+		t.Errorf("GetPeers() == %v, want [%v]", peers, expected)
+	}
+
+	// The id and the routing table survive a restart
+	statePath := nodes[2].config.StatePath
+	id := nodes[2].Id
+	nodes[2].Close()
+
+	restarted := newTestNode(t, nil, statePath)
+	defer restarted.Close()
+	if restarted.Id != id {
+		t.Errorf("restarted.Id == %x, want %x", restarted.Id, id)
+	}
+	if restarted.Nodes() == 0 {
+		t.Errorf("restarted.Nodes() == 0, want the nodes of the previous session")
+	}
+}
@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// KRPC message types
+const (
+	QueryType    = "q"
+	ResponseType = "r"
+	ErrorType    = "e"
+)
+
+// KRPC error codes
+const (
+	GenericError  = 201
+	ServerError   = 202
+	ProtocolError = 203
+	UnknownMethod = 204
+)
+
+const (
+	// CompactNodeLength is the length of a node id followed by a compact IPv4 address
+	CompactNodeLength = NodeIdLength + 6
+)
+
+var (
+	ErrInvalidMessage = errors.New("Invalid KRPC message")
+	ErrInvalidNodes   = errors.New("Invalid compact node info")
+)
+
+// Message is a KRPC message: a query, a response or an error.
+// Args holds the arguments of a query and the values of a response.
+type Message struct {
+	TransactionId string
+	Type          string
+	Method        string
+	Args          map[string]interface{}
+	ErrorCode     int
+	ErrorMessage  string
+}
+
+func NewQuery(transactionId, method string, args map[string]interface{}) *Message {
+	return &Message{TransactionId: transactionId, Type: QueryType, Method: method, Args: args}
+}
+
+func NewResponse(transactionId string, values map[string]interface{}) *Message {
+	return &Message{TransactionId: transactionId, Type: ResponseType, Args: values}
+}
+
+func NewError(transactionId string, code int, message string) *Message {
+	return &Message{TransactionId: transactionId, Type: ErrorType, ErrorCode: code, ErrorMessage: message}
+}
+
+func (m *Message) Encode() (data []byte, err error) {
+	dict := map[string]interface{}{
+		"t": m.TransactionId,
+		"y": m.Type,
+	}
+
+	switch m.Type {
+	case QueryType:
+		dict["q"] = m.Method
+		dict["a"] = m.Args
+	case ResponseType:
+		dict["r"] = m.Args
+	case ErrorType:
+		dict["e"] = []interface{}{m.ErrorCode, m.ErrorMessage}
+	default:
+		err = ErrInvalidMessage
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err = bencode.Marshal(&buffer, dict); err != nil {
+		return
+	}
+	data = buffer.Bytes()
+	return
+}
+
+func DecodeMessage(data []byte) (m *Message, err error) {
+	result, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	dict, ok := result.(map[string]interface{})
+	if !ok {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m = new(Message)
+	m.TransactionId, _ = dict["t"].(string)
+	m.Type, _ = dict["y"].(string)
+
+	switch m.Type {
+	case QueryType:
+		m.Method, _ = dict["q"].(string)
+		m.Args, ok = dict["a"].(map[string]interface{})
+	case ResponseType:
+		m.Args, ok = dict["r"].(map[string]interface{})
+	case ErrorType:
+		var e []interface{}
+		if e, ok = dict["e"].([]interface{}); ok && len(e) == 2 {
+			code, _ := e[0].(int64)
+			m.ErrorCode = int(code)
+			m.ErrorMessage, _ = e[1].(string)
+		}
+	default:
+		ok = false
+	}
+
+	if !ok {
+		err = ErrInvalidMessage
+	}
+	return
+}
+
+// String returns a string argument or value, or an empty string if it's missing.
+func (m *Message) String(key string) string {
+	value, _ := m.Args[key].(string)
+	return value
+}
+
+// Int returns an integer argument or value, or 0 if it's missing.
+func (m *Message) Int(key string) int {
+	value, _ := m.Args[key].(int64)
+	return int(value)
+}
+
+// NodeId returns the id of the sender.
+func (m *Message) NodeId() (id NodeId, ok bool) {
+	id = NodeId(m.String("id"))
+	ok = len(id) == NodeIdLength
+	return
+}
+
+// encodeNodes returns the compact node info of the IPv4 nodes.
+func encodeNodes(nodes []*Node) string {
+	var buffer bytes.Buffer
+	for _, node := range nodes {
+		if ip := node.Addr.IP.To4(); ip != nil {
+			buffer.WriteString(string(node.Id))
+			buffer.Write(compactAddr(ip, node.Addr.Port))
+		}
+	}
+	return buffer.String()
+}
+
+func decodeNodes(data string) (nodes []*Node, err error) {
+	if len(data)%CompactNodeLength != 0 {
+		err = ErrInvalidNodes
+		return
+	}
+
+	for i := 0; i < len(data); i += CompactNodeLength {
+		compact := data[i : i+CompactNodeLength]
+		addr := parseCompactAddr(compact[NodeIdLength:])
+		if addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, &Node{Id: NodeId(compact[:NodeIdLength]), Addr: &net.UDPAddr{IP: addr.IP, Port: addr.Port}})
+	}
+	return
+}
+
+// compactAddr encodes an IP address followed by a port in network byte order.
+func compactAddr(ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(port))
+	return compact
+}
+
+func parseCompactAddr(compact string) (addr net.TCPAddr) {
+	if len(compact) != net.IPv4len+2 && len(compact) != net.IPv6len+2 {
+		return
+	}
+
+	ipLen := len(compact) - 2
+	addr.IP = make(net.IP, ipLen)
+	copy(addr.IP, compact[:ipLen])
+	addr.Port = int(binary.BigEndian.Uint16([]byte(compact[ipLen:])))
+	return
+}
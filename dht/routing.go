@@ -0,0 +1,271 @@
+package dht
+
+import (
+	"code.google.com/p/bencode-go"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	NodeIdLength = 20
+	// K is the size of a bucket and of the result of a lookup
+	K = 8
+	// MaxNodeFailures is the number of unanswered queries after which a node is removed
+	MaxNodeFailures = 3
+	// NodeQuestionableAfter is how long a node stays good without any message from it
+	NodeQuestionableAfter = 15 * time.Minute
+)
+
+var ErrInvalidRoutingTable = errors.New("Invalid routing table file")
+
+// NodeId identifies a node, it's in the same space as the info hashes.
+type NodeId string
+
+func NewNodeId() NodeId {
+	id := make([]byte, NodeIdLength)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return NodeId(id)
+}
+
+// commonPrefixLen returns the number of leading bits shared by two ids.
+func commonPrefixLen(a, b NodeId) int {
+	for i := 0; i < NodeIdLength; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return NodeIdLength * 8
+}
+
+// closer returns true if a is closer to target than b, according to the XOR metric.
+func closer(target, a, b NodeId) bool {
+	for i := 0; i < NodeIdLength; i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+type Node struct {
+	Id       NodeId
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	failures int
+}
+
+func (n *Node) IsGood(now time.Time) bool {
+	return n.failures == 0 && now.Sub(n.LastSeen) < NodeQuestionableAfter
+}
+
+// RoutingTable stores the known nodes in 160 buckets, bucket i holds the
+// nodes whose id shares exactly i leading bits with ours.
+// Nodes are kept from the least to the most recently seen.
+type RoutingTable struct {
+	Self    NodeId
+	buckets [NodeIdLength * 8][]*Node
+	lock    sync.Mutex
+}
+
+func NewRoutingTable(self NodeId) *RoutingTable {
+	rt := new(RoutingTable)
+	rt.Self = self
+	return rt
+}
+
+// Update records that a node has sent us a message.
+// A full bucket only accepts a new node in place of a failing one.
+func (rt *RoutingTable) Update(id NodeId, addr *net.UDPAddr, now time.Time) {
+	if len(id) != NodeIdLength || id == rt.Self {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	i := rt.bucketIndex(id)
+	bucket := rt.buckets[i]
+	for j, node := range bucket {
+		if node.Id == id {
+			node.Addr = addr
+			node.LastSeen = now
+			node.failures = 0
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), node)
+			return
+		}
+	}
+
+	node := &Node{Id: id, Addr: addr, LastSeen: now}
+	if len(bucket) < K {
+		rt.buckets[i] = append(bucket, node)
+		return
+	}
+
+	for j, old := range bucket {
+		if !old.IsGood(now) {
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), node)
+			return
+		}
+	}
+}
+
+// Failed records that a node hasn't answered a query.
+func (rt *RoutingTable) Failed(addr *net.UDPAddr) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for i, bucket := range rt.buckets {
+		for j, node := range bucket {
+			if node.Addr.String() != addr.String() {
+				continue
+			}
+			node.failures++
+			if node.failures >= MaxNodeFailures {
+				rt.buckets[i] = append(bucket[:j:j], bucket[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// Closest returns up to count nodes, from the closest to the farthest from target.
+func (rt *RoutingTable) Closest(target NodeId, count int) []*Node {
+	nodes := rt.Nodes()
+	sort.Sort(byDistance{nodes, target})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func (rt *RoutingTable) Nodes() (nodes []*Node) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			copied := *node
+			nodes = append(nodes, &copied)
+		}
+	}
+	return
+}
+
+func (rt *RoutingTable) Len() (n int) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return
+}
+
+// StaleBuckets returns a random id in the range of every non-empty bucket
+// which hasn't seen any node for NodeQuestionableAfter.
+func (rt *RoutingTable) StaleBuckets(now time.Time) (targets []NodeId) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for i, bucket := range rt.buckets {
+		if len(bucket) == 0 || now.Sub(bucket[len(bucket)-1].LastSeen) < NodeQuestionableAfter {
+			continue
+		}
+		targets = append(targets, randomIdInBucket(rt.Self, i))
+	}
+	return
+}
+
+func (rt *RoutingTable) bucketIndex(id NodeId) int {
+	i := commonPrefixLen(rt.Self, id)
+	if i == len(rt.buckets) {
+		i--
+	}
+	return i
+}
+
+// randomIdInBucket returns an id which shares exactly prefix leading bits with self.
+func randomIdInBucket(self NodeId, prefix int) NodeId {
+	id := []byte(NewNodeId())
+	for bit := 0; bit <= prefix && bit < NodeIdLength*8; bit++ {
+		mask := byte(0x80) >> uint(bit%8)
+		value := self[bit/8] & mask
+		if bit == prefix {
+			value ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | value
+	}
+	return NodeId(id)
+}
+
+// Save writes our id and the known nodes to a file, so that the next
+// session doesn't have to bootstrap from scratch.
+func (rt *RoutingTable) Save(path string) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return bencode.Marshal(file, map[string]interface{}{
+		"id":    string(rt.Self),
+		"nodes": encodeNodes(rt.Nodes()),
+	})
+}
+
+// LoadRoutingTable reads a file written by Save,
+// the nodes have to be pinged before being added to the table.
+func LoadRoutingTable(path string) (self NodeId, nodes []*Node, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	result, err := bencode.Decode(file)
+	if err != nil {
+		return
+	}
+
+	dict, ok := result.(map[string]interface{})
+	if !ok {
+		err = ErrInvalidRoutingTable
+		return
+	}
+
+	id, _ := dict["id"].(string)
+	compactNodes, _ := dict["nodes"].(string)
+	if len(id) != NodeIdLength {
+		err = ErrInvalidRoutingTable
+		return
+	}
+
+	self = NodeId(id)
+	nodes, err = decodeNodes(compactNodes)
+	return
+}
+
+// byDistance sorts nodes from the closest to the farthest from target.
+type byDistance struct {
+	nodes  []*Node
+	target NodeId
+}
+
+func (s byDistance) Len() int      { return len(s.nodes) }
+func (s byDistance) Swap(i, j int) { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+func (s byDistance) Less(i, j int) bool {
+	return closer(s.target, s.nodes[i].Id, s.nodes[j].Id)
+}
@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+)
+
+const secretLength = 16
+
+// tokenManager hands out the tokens required by announce_peer.
+// A token is the hash of the querying IP address and of a secret which is
+// rotated periodically, the tokens of the previous secret are still accepted.
+type tokenManager struct {
+	secret   []byte
+	previous []byte
+	lock     sync.Mutex
+}
+
+func newTokenManager() *tokenManager {
+	tm := new(tokenManager)
+	tm.secret = newSecret()
+	tm.previous = tm.secret
+	return tm
+}
+
+func newSecret() []byte {
+	secret := make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func (tm *tokenManager) Token(ip net.IP) string {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	return token(tm.secret, ip)
+}
+
+func (tm *tokenManager) IsValid(t string, ip net.IP) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	return t == token(tm.secret, ip) || t == token(tm.previous, ip)
+}
+
+func (tm *tokenManager) Rotate() {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	tm.previous = tm.secret
+	tm.secret = newSecret()
+}
+
+func token(secret []byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hash := sha1.New()
+	hash.Write(secret)
+	hash.Write(ip)
+	return string(hash.Sum(nil))
+}
@@ -0,0 +1,204 @@
+package gotorrent
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	log "code.google.com/p/tcgl/applog"
+	"errors"
+	"github.com/moretti/gotorrent/messages"
+	"net"
+	"time"
+)
+
+// ClientVersionString is sent in the "v" key of the extended handshake
+const ClientVersionString = "GoTorrent " + ClientVersion
+
+var ErrInvalidExtendedHandshake = errors.New("Invalid extended handshake")
+
+// Extension is a protocol extension negotiated through the Extension Protocol (BEP 10).
+// Each PeerManager has its own instance of every registered extension,
+// its methods are called from the PeerManager goroutine.
+type Extension interface {
+	// Name is the key of the extension in the "m" dictionary, i.e. "ut_metadata"
+	Name() string
+	// ExtendHandshake adds the keys of the extension to our extended handshake
+	ExtendHandshake(handshake map[string]interface{})
+	// PeerHandshake is called when a peer supporting the extension sends its extended handshake
+	PeerHandshake(peer *Peer, handshake *ExtendedHandshake)
+	// HandleMessage processes a message the peer has sent to the extension
+	HandleMessage(peer *Peer, payload []byte) error
+}
+
+// ExtensionTimer is implemented by the extensions which have periodic work to do,
+// Tick is called every RequestTimeoutInterval.
+type ExtensionTimer interface {
+	Tick(now time.Time)
+}
+
+// ExtensionFactory creates the instance of an extension for a torrent.
+type ExtensionFactory func(pm *PeerManager) Extension
+
+var extensionFactories []ExtensionFactory
+
+// RegisterExtension makes an extension available to the torrents created afterwards,
+// it's meant to be called from an init function.
+// Our extended message ids are assigned in registration order, starting from 1.
+func RegisterExtension(factory ExtensionFactory) {
+	extensionFactories = append(extensionFactories, factory)
+}
+
+// ExtendedHandshake is the handshake of the Extension Protocol.
+// Dict holds every key, so that extensions can read their own.
+type ExtendedHandshake struct {
+	M            map[string]byte
+	V            string
+	P            int
+	Reqq         int
+	YourIp       net.IP
+	MetadataSize int
+
+	Dict map[string]interface{}
+}
+
+func parseExtendedHandshake(payload []byte) (handshake *ExtendedHandshake, err error) {
+	dict, err := decodeDict(payload)
+	if err != nil {
+		return
+	}
+
+	handshake = new(ExtendedHandshake)
+	handshake.Dict = dict
+	handshake.M = make(map[string]byte)
+
+	m, ok := dict["m"].(map[string]interface{})
+	if !ok {
+		err = ErrInvalidExtendedHandshake
+		return
+	}
+	for name, value := range m {
+		// An id of 0 means that the extension has been disabled
+		if id, ok := value.(int64); ok && id > 0 && id < 256 {
+			handshake.M[name] = byte(id)
+		}
+	}
+
+	handshake.V, _ = dict["v"].(string)
+	handshake.P = dictInt(dict, "p")
+	handshake.Reqq = dictInt(dict, "reqq")
+	handshake.MetadataSize = dictInt(dict, "metadata_size")
+	if yourIp, ok := dict["yourip"].(string); ok && (len(yourIp) == net.IPv4len || len(yourIp) == net.IPv6len) {
+		handshake.YourIp = net.IP(yourIp)
+	}
+	return
+}
+
+func decodeDict(payload []byte) (dict map[string]interface{}, err error) {
+	result, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+
+	dict, ok := result.(map[string]interface{})
+	if !ok {
+		err = errors.New("Bencoded dictionary expected")
+	}
+	return
+}
+
+func encodeDict(dict map[string]interface{}) (payload []byte, err error) {
+	var buffer bytes.Buffer
+	if err = bencode.Marshal(&buffer, dict); err != nil {
+		return
+	}
+	payload = buffer.Bytes()
+	return
+}
+
+func dictInt(dict map[string]interface{}, key string) int {
+	value, _ := dict[key].(int64)
+	return int(value)
+}
+
+// sendExtendedHandshake advertises our extensions to a peer supporting the Extension Protocol.
+func (pm *PeerManager) sendExtendedHandshake(peer *Peer) {
+	if !peer.SupportsExtensions() {
+		return
+	}
+
+	m := make(map[string]interface{})
+	for i, extension := range pm.extensions {
+		m[extension.Name()] = i + 1
+	}
+
+	handshake := map[string]interface{}{
+		"m":    m,
+		"v":    ClientVersionString,
+		"p":    pm.Torrent.Port,
+		"reqq": PeerMaxQueuedRequests,
+	}
+
+	ip := peer.connection.addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	handshake["yourip"] = string(ip)
+	// The peer may reach us over IPv6 too, see BEP 10
+	if pm.Torrent.IPv6 != nil {
+		handshake["ipv6"] = string(pm.Torrent.IPv6.To16())
+	}
+
+	for _, extension := range pm.extensions {
+		extension.ExtendHandshake(handshake)
+	}
+
+	payload, err := encodeDict(handshake)
+	if err != nil {
+		log.Errorf("Peer %v - Unable to encode the extended handshake: %v", peer.String(), err)
+		return
+	}
+
+	peer.SendExtended(messages.ExtendedHandshakeId, payload)
+}
+
+func (pm *PeerManager) processExtended(message messages.Message, peer *Peer) {
+	if !peer.SupportsExtensions() {
+		log.Errorf("Peer %v - Extended message without support", peer.String())
+		pm.dropPeer(peer)
+		return
+	}
+
+	extended, err := message.ToExtended()
+	if err != nil {
+		log.Errorf("Peer %v - Unable to parse the extended message: %v", peer.String(), err)
+		return
+	}
+
+	if extended.ExtendedId == messages.ExtendedHandshakeId {
+		handshake, err := parseExtendedHandshake(extended.Payload)
+		if err != nil {
+			log.Errorf("Peer %v - Unable to parse the extended handshake: %v", peer.String(), err)
+			return
+		}
+
+		log.Debugf("Peer %v - Extended handshake, client: %v, extensions: %v", peer.String(), handshake.V, handshake.M)
+		peer.SetExtendedHandshake(handshake)
+
+		for _, extension := range pm.extensions {
+			if _, ok := handshake.M[extension.Name()]; ok {
+				extension.PeerHandshake(peer, handshake)
+			}
+		}
+		return
+	}
+
+	i := int(extended.ExtendedId) - 1
+	if i < 0 || i >= len(pm.extensions) {
+		log.Errorf("Peer %v - Unknown extended message id: %v", peer.String(), extended.ExtendedId)
+		return
+	}
+
+	extension := pm.extensions[i]
+	if err = extension.HandleMessage(peer, extended.Payload); err != nil {
+		log.Errorf("Peer %v - %v: %v", peer.String(), extension.Name(), err)
+	}
+}
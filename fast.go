@@ -0,0 +1,129 @@
+package gotorrent
+
+import (
+	log "code.google.com/p/tcgl/applog"
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/moretti/gotorrent/messages"
+	"net"
+)
+
+const (
+	// AllowedFastSetSize is the number of pieces a choked peer can download from us
+	AllowedFastSetSize = 10
+)
+
+// allowedFastSet computes the canonical allowed fast set described in BEP 6,
+// it's only defined for IPv4 peers.
+func allowedFastSet(ip net.IP, infoHash string, pieceCount, k int) (pieces []int) {
+	ip = ip.To4()
+	if ip == nil || pieceCount == 0 {
+		return
+	}
+
+	if k > pieceCount {
+		k = pieceCount
+	}
+
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash...)
+
+	seen := make(map[int]bool)
+	for len(pieces) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(pieces) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(pieceCount))
+			if !seen[index] {
+				seen[index] = true
+				pieces = append(pieces, index)
+			}
+		}
+	}
+	return
+}
+
+// announcePieces tells a newly identified peer which pieces we have,
+// fast peers get Have All or Have None when possible, and their allowed fast set.
+func (pm *PeerManager) announcePieces(peer *Peer) {
+	completed := pm.Torrent.CompletedPieces
+
+	switch {
+	case peer.SupportsFast() && pm.Torrent.IsSeeding():
+		peer.SendHaveAll()
+	case peer.SupportsFast() && completed.Cardinality() == 0:
+		peer.SendHaveNone()
+	case completed.Cardinality() > 0:
+		peer.SendBitField(completed.Bytes())
+	}
+
+	if !peer.SupportsFast() {
+		return
+	}
+
+	addr := peer.connection.addr
+	for _, index := range allowedFastSet(addr.IP, pm.Torrent.InfoHash, pm.Torrent.PieceCount, AllowedFastSetSize) {
+		peer.GrantFast(index)
+		if completed.IsSet(index) {
+			peer.SendAllowedFast(index)
+		}
+	}
+}
+
+// processFastMessage handles the messages of the Fast Extension,
+// it returns false if the message id doesn't belong to it.
+func (pm *PeerManager) processFastMessage(message messages.Message, peer *Peer) bool {
+	switch message.Header.Id {
+	case messages.SuggestPieceId, messages.HaveAllId, messages.HaveNoneId,
+		messages.RejectRequestId, messages.AllowedFastId:
+	default:
+		return false
+	}
+
+	if !peer.SupportsFast() {
+		log.Errorf("Peer %v - Fast extension message without support: %v", peer.String(), message.Header.Id)
+		pm.dropPeer(peer)
+		return true
+	}
+
+	switch message.Header.Id {
+	case messages.SuggestPieceId:
+		suggest, err := message.ToSuggestPiece()
+		if err != nil || int(suggest.PieceIndex) >= pm.Torrent.PieceCount {
+			log.Errorf("Peer %v - Invalid suggest piece message: %v", peer.String(), err)
+			return true
+		}
+		log.Debugf("Peer %v - Suggest piece #%v", peer.String(), suggest.PieceIndex)
+		peer.Suggest(int(suggest.PieceIndex))
+		pm.requestBlocks(peer)
+
+	case messages.HaveAllId, messages.HaveNoneId:
+		pm.picker.RemoveBitField(peer.BitField())
+		peer.SetHaveAll(message.Header.Id == messages.HaveAllId)
+		pm.picker.AddBitField(peer.BitField())
+		pm.requestBlocks(peer)
+
+	case messages.RejectRequestId:
+		reject, err := message.ToRejectRequest()
+		if err != nil {
+			log.Errorf("Peer %v - Unable to parse the reject request message: %v", peer.String(), err)
+			return true
+		}
+		log.Debugf("Peer %v - Rejected piece #%v offset %v", peer.String(), reject.PieceIndex, reject.BlockOffset)
+		if block := peer.RejectBlock(int(reject.PieceIndex), int(reject.BlockOffset)); block != nil {
+			pm.releaseBlocks(peer, []*PendingBlock{block})
+		}
+
+	case messages.AllowedFastId:
+		allowedFast, err := message.ToAllowedFast()
+		if err != nil || int(allowedFast.PieceIndex) >= pm.Torrent.PieceCount {
+			log.Errorf("Peer %v - Invalid allowed fast message: %v", peer.String(), err)
+			return true
+		}
+		log.Debugf("Peer %v - Allowed fast piece #%v", peer.String(), allowedFast.PieceIndex)
+		peer.SetAllowedFast(int(allowedFast.PieceIndex))
+		pm.requestBlocks(peer)
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package gotorrent
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// Test vectors from BEP 6
+func TestAllowedFastSet(t *testing.T) {
+	ip := net.ParseIP("80.4.4.200")
+	infoHash := strings.Repeat("\xaa", 20)
+
+	{
+		expected := []int{1059, 431, 808, 1217, 287, 376, 1188}
+		value := allowedFastSet(ip, infoHash, 1313, 7)
+		if !equalInts(value, expected) {
+			t.Errorf("allowedFastSet(k=7) == %v, want %v", value, expected)
+		}
+	}
+
+	{
+		expected := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+		value := allowedFastSet(ip, infoHash, 1313, 9)
+		if !equalInts(value, expected) {
+			t.Errorf("allowedFastSet(k=9) == %v, want %v", value, expected)
+		}
+	}
+
+	// The set can't be larger than the torrent
+	{
+		expected := 3
+		value := len(allowedFastSet(ip, infoHash, 3, 10))
+		if value != expected {
+			t.Errorf("len(allowedFastSet(sz=3)) == %v, want %v", value, expected)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, c := range a {
+		if c != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -16,6 +16,16 @@ func main() {
 
 	torrentPath := args[1]
 	client := gotorrent.NewClient()
-	torrent := client.AddTorrent(torrentPath)
+	if err := client.Listen(); err != nil {
+		fmt.Println("Unable to listen:", err)
+		return
+	}
+	defer client.Close()
+
+	torrent, err := client.AddTorrent(torrentPath)
+	if err != nil {
+		fmt.Println("Unable to add the torrent:", err)
+		return
+	}
 	torrent.Test()
 }
@@ -0,0 +1,326 @@
+// Package ipfilter blocks the IP ranges of a blocklist, in the eMule
+// ipfilter.dat, PeerGuardian P2P or CIDR formats.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxAccessLevel is the highest ipfilter.dat access level which is
+	// blocked, the ranges above it are allowed as in eMule
+	MaxAccessLevel = 127
+	// ReloadInterval is how often a watched blocklist is checked for changes
+	ReloadInterval = time.Minute
+)
+
+var (
+	ErrInvalidRange     = errors.New("Invalid IP range")
+	ErrInvalidBlocklist = errors.New("Invalid blocklist, no valid range")
+)
+
+// Range is an inclusive range of addresses, IPv4 addresses are kept in their
+// 16 bytes form so that all the ranges compare.
+type Range struct {
+	First net.IP
+	Last  net.IP
+}
+
+func (r Range) String() string {
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// Filter looks addresses up in a list of ranges. It's safe for concurrent
+// use, the list can be reloaded or replaced while it's used.
+type Filter struct {
+	lock    sync.RWMutex
+	path    string
+	modTime time.Time
+	ranges  []Range
+	skipped int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a filter blocking ranges.
+func New(ranges []Range) *Filter {
+	f := new(Filter)
+	f.ranges = merge(ranges)
+	f.done = make(chan struct{})
+	return f
+}
+
+// Load reads a blocklist file, which can be reloaded.
+func Load(path string) (f *Filter, err error) {
+	f = New(nil)
+	if err = f.Open(path); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Open replaces the ranges with those of a blocklist file, the file reloaded
+// from then on. The filter is unchanged on error.
+func (f *Filter) Open(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	ranges, skipped, err := Parse(file)
+	if err != nil {
+		return err
+	}
+	// Not a blocklist at all, rather than a few broken lines
+	if len(ranges) == 0 && skipped > 0 {
+		return ErrInvalidBlocklist
+	}
+
+	ranges = merge(ranges)
+	f.lock.Lock()
+	f.path = path
+	f.modTime = info.ModTime()
+	f.ranges = ranges
+	f.skipped = skipped
+	f.lock.Unlock()
+	return nil
+}
+
+// Reload reads the blocklist file again, the filter is unchanged on error.
+func (f *Filter) Reload() error {
+	f.lock.RLock()
+	path := f.path
+	f.lock.RUnlock()
+
+	return f.Open(path)
+}
+
+// Watch reloads the blocklist whenever the file is modified, until Close.
+// The errors are passed to onError, which can be nil.
+func (f *Filter) Watch(interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-f.done:
+				return
+			}
+
+			f.lock.RLock()
+			path, modTime := f.path, f.modTime
+			f.lock.RUnlock()
+			// Nothing has been opened yet
+			if path == "" {
+				continue
+			}
+
+			info, err := os.Stat(path)
+			if err == nil && !info.ModTime().Equal(modTime) {
+				err = f.Reload()
+			}
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+}
+
+// Close stops watching the blocklist.
+func (f *Filter) Close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+// Blocked returns true if ip is in one of the ranges.
+func (f *Filter) Blocked(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	// The first range ending at or after ip is the only one which can contain it
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].Last, ip) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].First, ip) <= 0
+}
+
+// Len returns the number of ranges, once the overlapping ones are merged.
+func (f *Filter) Len() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return len(f.ranges)
+}
+
+// Skipped returns the number of invalid lines of the blocklist file.
+func (f *Filter) Skipped() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.skipped
+}
+
+// Parse reads a blocklist, the format is detected on every line:
+//
+//	001.002.003.004 - 001.002.003.255 , 000 , Description   (ipfilter.dat)
+//	Description:1.2.3.4-1.2.3.255                          (P2P)
+//	1.2.3.0/24                                             (CIDR)
+//
+// IPv6 ranges and single addresses are accepted too.
+//
+// Empty lines and comments starting with # or // are skipped. So are the
+// invalid lines, the large published lists often have a few, they are counted.
+func Parse(r io.Reader) (ranges []Range, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		ipRange, blocked, err := parseLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, ipRange)
+		}
+	}
+	return ranges, skipped, scanner.Err()
+}
+
+func parseLine(line string) (r Range, blocked bool, err error) {
+	if _, ipNet, cidrErr := net.ParseCIDR(line); cidrErr == nil {
+		return cidrRange(ipNet), true, nil
+	}
+	if ip := parseIP(line); ip != nil {
+		return Range{ip, ip}, true, nil
+	}
+
+	// P2P, the description may contain colons
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if r, err = parseRange(line[i+1:]); err == nil {
+			return r, true, nil
+		}
+	}
+
+	// ipfilter.dat
+	fields := strings.Split(line, ",")
+	if r, err = parseRange(fields[0]); err != nil {
+		return
+	}
+	if len(fields) > 1 {
+		level, levelErr := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if levelErr != nil {
+			err = ErrInvalidRange
+			return
+		}
+		return r, level <= MaxAccessLevel, nil
+	}
+	return r, true, nil
+}
+
+func parseRange(s string) (r Range, err error) {
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		err = ErrInvalidRange
+		return
+	}
+
+	r.First = parseIP(strings.TrimSpace(bounds[0]))
+	r.Last = parseIP(strings.TrimSpace(bounds[1]))
+	if r.First == nil || r.Last == nil || bytes.Compare(r.First, r.Last) > 0 ||
+		(r.First.To4() == nil) != (r.Last.To4() == nil) {
+		err = ErrInvalidRange
+	}
+	return
+}
+
+// parseIP accepts the zero padded IPv4 addresses of ipfilter.dat,
+// it returns the 16 bytes form.
+func parseIP(s string) net.IP {
+	if parts := strings.Split(s, "."); len(parts) == 4 && !strings.Contains(s, ":") {
+		for i, part := range parts {
+			if trimmed := strings.TrimLeft(part, "0"); trimmed != "" {
+				parts[i] = trimmed
+			} else if part != "" {
+				parts[i] = "0"
+			}
+		}
+		s = strings.Join(parts, ".")
+	}
+	return net.ParseIP(s).To16()
+}
+
+func cidrRange(ipNet *net.IPNet) Range {
+	first := ipNet.IP.To16()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+
+	last := make(net.IP, net.IPv6len)
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+	return Range{first, last}
+}
+
+// merge sorts the ranges and joins those which overlap or are adjacent.
+func merge(ranges []Range) (merged []Range) {
+	sorted := append([]Range(nil), ranges...)
+	sort.Sort(byFirst(sorted))
+
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && bytes.Compare(r.First, next(merged[n-1].Last)) <= 0 {
+			if bytes.Compare(r.Last, merged[n-1].Last) > 0 {
+				merged[n-1].Last = r.Last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return
+}
+
+// next returns the address following ip, ip itself for the last address.
+func next(ip net.IP) net.IP {
+	n := append(net.IP(nil), ip...)
+	for i := len(n) - 1; i >= 0; i-- {
+		if n[i]++; n[i] != 0 {
+			return n
+		}
+	}
+	return ip
+}
+
+type byFirst []Range
+
+func (r byFirst) Len() int           { return len(r) }
+func (r byFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFirst) Less(i, j int) bool { return bytes.Compare(r[i].First, r[j].First) < 0 }
@@ -0,0 +1,128 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const blocklist = `# Comments and empty lines are skipped
+
+001.002.003.000 - 001.002.003.255 , 000 , ipfilter.dat range
+005.006.007.000 - 005.006.007.255 , 200 , Allowed by its access level
+Some:Organization:10.0.0.0-10.0.255.255
+10.1.0.0 - 10.1.0.255 , 100 , Adjacent to nothing
+192.168.0.0/16
+8.8.8.8
+2001:db8::/32
+`
+
+func TestFilter(t *testing.T) {
+	ranges, skipped, err := Parse(strings.NewReader(blocklist))
+	if err != nil || skipped != 0 {
+		t.Fatalf("Parse() returned %v, %v lines skipped", err, skipped)
+	}
+	f := New(ranges)
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"1.2.3.0", true},
+		{"1.2.3.255", true},
+		{"1.2.4.0", false},
+		{"5.6.7.8", false},
+		{"10.0.128.1", true},
+		{"10.1.0.1", true},
+		{"10.2.0.1", false},
+		{"192.168.42.42", true},
+		{"8.8.8.8", true},
+		{"8.8.4.4", false},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:192.168.1.1", true},
+	}
+
+	for _, test := range tests {
+		if value := f.Blocked(net.ParseIP(test.ip)); value != test.expected {
+			t.Errorf("Blocked(%v) == %v, want %v", test.ip, value, test.expected)
+		}
+	}
+
+	// Overlapping and adjacent ranges are merged
+	{
+		ranges, _, _ := Parse(strings.NewReader("1.0.0.0-1.0.0.255\n1.0.1.0/24\n1.0.0.128-1.0.0.200\n"))
+		expected := 1
+		if value := New(ranges).Len(); value != expected {
+			t.Errorf("Len() == %v, want %v", value, expected)
+		}
+	}
+
+	// The invalid lines are skipped and counted
+	{
+		ranges, skipped, err := Parse(strings.NewReader("1.2.3.4 - garbage\n1.2.3.4\nGarbage:1.2.3\n"))
+		if err != nil || len(ranges) != 1 || skipped != 2 {
+			t.Errorf("Parse() == %v, %v, %v, want 1 range, 2 lines skipped", ranges, skipped, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocklist.p2p")
+	if err = ioutil.WriteFile(path, []byte("First:1.2.3.0-1.2.3.255\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() returned %v", err)
+	}
+	defer f.Close()
+	f.Watch(10*time.Millisecond, nil)
+
+	ip := net.ParseIP("4.5.6.7")
+	if f.Blocked(ip) {
+		t.Fatalf("Blocked(%v) == true before the reload", ip)
+	}
+
+	// The modification time may have a coarse resolution
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(path, []byte("Second:4.5.6.0-4.5.6.255\n"), 0644)
+	os.Chtimes(path, later, later)
+
+	for deadline := time.Now().Add(5 * time.Second); !f.Blocked(ip); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Blocked(%v) == false after the reload", ip)
+		}
+	}
+	if f.Blocked(net.ParseIP("1.2.3.4")) {
+		t.Errorf("Blocked(1.2.3.4) == true after the reload")
+	}
+
+	// Another file replaces the ranges of the same filter, a file without
+	// any valid line leaves them unchanged
+	other := filepath.Join(dir, "other.p2p")
+	ioutil.WriteFile(other, []byte("Third:7.8.9.0-7.8.9.255\nBroken:7.8.9\n"), 0644)
+	if err = f.Open(other); err != nil {
+		t.Fatalf("Open() returned %v", err)
+	}
+	if !f.Blocked(net.ParseIP("7.8.9.10")) || f.Blocked(ip) || f.Skipped() != 1 {
+		t.Errorf("Blocked() == %v, %v, Skipped() == %v after Open(), want true, false, 1",
+			f.Blocked(net.ParseIP("7.8.9.10")), f.Blocked(ip), f.Skipped())
+	}
+
+	ioutil.WriteFile(other, []byte("Not a blocklist\n"), 0644)
+	if err = f.Open(other); err != ErrInvalidBlocklist || !f.Blocked(net.ParseIP("7.8.9.10")) {
+		t.Errorf("Open() returned %v, want %v and the ranges unchanged", err, ErrInvalidBlocklist)
+	}
+}
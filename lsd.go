@@ -0,0 +1,256 @@
+package gotorrent
+
+import (
+	"bufio"
+	"bytes"
+	log "code.google.com/p/tcgl/applog"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LSDMulticastAddr  = "239.192.152.143:6771"
+	LSDMulticastAddr6 = "[ff15::efc0:988f]:6771"
+	// LSDInterval is how often every torrent is announced on the local network
+	LSDInterval = 5 * time.Minute
+	// LSDMinInterval is the shortest time between two announces of the same torrent
+	LSDMinInterval = time.Minute
+	// LSDMaxInfoHashes keeps an announce within a single datagram
+	LSDMaxInfoHashes = 20
+	lsdMaxPacketSize = 1500
+)
+
+var ErrInvalidLSDMessage = errors.New("Invalid local service discovery message")
+
+// LocalDiscovery implements Local Service Discovery (BEP 14): our torrents are
+// announced through multicast, and the peers announcing them on the LAN are
+// added to their PeerManager.
+type LocalDiscovery struct {
+	client *Client
+	cookie string
+	groups []*lsdGroup
+
+	announced map[string]time.Time
+	lock      sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// lsdGroup is the multicast group of an address family.
+type lsdGroup struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
+// LSDAnnounce is a BT-SEARCH message, Host is the multicast group it's sent to.
+type LSDAnnounce struct {
+	Host       string
+	Port       int
+	InfoHashes []string
+	Cookie     string
+}
+
+func NewLocalDiscovery(client *Client) (lsd *LocalDiscovery, err error) {
+	lsd = new(LocalDiscovery)
+	lsd.client = client
+	lsd.announced = make(map[string]time.Time)
+	lsd.done = make(chan struct{})
+
+	cookie := make([]byte, 8)
+	if _, err = rand.Read(cookie); err != nil {
+		return
+	}
+	lsd.cookie = hex.EncodeToString(cookie)
+
+	// Either address family is enough
+	for _, group := range []struct{ network, addr string }{
+		{"udp4", LSDMulticastAddr},
+		{"udp6", LSDMulticastAddr6},
+	} {
+		g, joinErr := joinLSDGroup(group.network, group.addr)
+		if joinErr != nil {
+			log.Debugf("LSD - Unable to join %v: %v", group.addr, joinErr)
+			err = joinErr
+			continue
+		}
+		lsd.groups = append(lsd.groups, g)
+	}
+	if len(lsd.groups) > 0 {
+		err = nil
+	}
+	return
+}
+
+func joinLSDGroup(network, addr string) (group *lsdGroup, err error) {
+	group = new(lsdGroup)
+	if group.addr, err = net.ResolveUDPAddr(network, addr); err != nil {
+		return
+	}
+	group.conn, err = net.ListenMulticastUDP(network, nil, group.addr)
+	return
+}
+
+func (lsd *LocalDiscovery) Start() {
+	for _, group := range lsd.groups {
+		go lsd.read(group)
+	}
+	go lsd.announceLoop()
+}
+
+func (lsd *LocalDiscovery) Close() (err error) {
+	lsd.closeOnce.Do(func() {
+		close(lsd.done)
+		for _, group := range lsd.groups {
+			if closeErr := group.conn.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	return
+}
+
+// Announce sends the info hashes of the public torrents which haven't been announced lately.
+func (lsd *LocalDiscovery) Announce(torrents ...*Torrent) {
+	now := time.Now()
+
+	var infoHashes []string
+	lsd.lock.Lock()
+	for _, torrent := range torrents {
+		if torrent.Private || now.Sub(lsd.announced[torrent.InfoHash]) < LSDMinInterval {
+			continue
+		}
+		lsd.announced[torrent.InfoHash] = now
+		infoHashes = append(infoHashes, torrent.InfoHash)
+	}
+	lsd.lock.Unlock()
+
+	for len(infoHashes) > 0 {
+		n := len(infoHashes)
+		if n > LSDMaxInfoHashes {
+			n = LSDMaxInfoHashes
+		}
+
+		for _, group := range lsd.groups {
+			announce := LSDAnnounce{Host: group.addr.String(), Port: lsd.client.Port, InfoHashes: infoHashes[:n], Cookie: lsd.cookie}
+			if _, err := group.conn.WriteToUDP(announce.Marshal(), group.addr); err != nil {
+				log.Errorf("LSD - Unable to announce to %v: %v", group.addr, err)
+			}
+		}
+		infoHashes = infoHashes[n:]
+	}
+}
+
+func (lsd *LocalDiscovery) announceLoop() {
+	ticker := time.NewTicker(LSDInterval)
+	defer ticker.Stop()
+
+	for {
+		lsd.client.torrentsLock.Lock()
+		torrents := append([]*Torrent(nil), lsd.client.Torrents...)
+		lsd.client.torrentsLock.Unlock()
+		lsd.Announce(torrents...)
+
+		select {
+		case <-ticker.C:
+		case <-lsd.done:
+			return
+		}
+	}
+}
+
+func (lsd *LocalDiscovery) read(group *lsdGroup) {
+	buffer := make([]byte, lsdMaxPacketSize)
+	for {
+		n, addr, err := group.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-lsd.done:
+			default:
+				log.Errorf("LSD - Unable to read: %v", err)
+			}
+			return
+		}
+
+		announce, err := ParseLSDAnnounce(buffer[:n])
+		if err != nil {
+			log.Debugf("LSD - Invalid message from %v: %v", addr, err)
+			continue
+		}
+		if announce.Cookie == lsd.cookie {
+			continue
+		}
+
+		peerAddr := net.TCPAddr{IP: addr.IP, Port: announce.Port}
+		for _, infoHash := range announce.InfoHashes {
+			torrent := lsd.client.findTorrent(infoHash)
+			if torrent == nil || torrent.Private {
+				continue
+			}
+
+			log.Debugf("LSD - Found peer %v", peerAddr.String())
+			select {
+			case torrent.PeerManager.AddPeerAddr <- PeerAddr{Addr: peerAddr, Source: SourceLSD}:
+			case <-lsd.done:
+				return
+			}
+		}
+	}
+}
+
+// Marshal formats the announce as an HTTP-like BT-SEARCH request.
+func (announce *LSDAnnounce) Marshal() []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "BT-SEARCH * HTTP/1.1\r\n")
+	host := announce.Host
+	if host == "" {
+		host = LSDMulticastAddr
+	}
+	fmt.Fprintf(&buffer, "Host: %v\r\n", host)
+	fmt.Fprintf(&buffer, "Port: %v\r\n", announce.Port)
+	for _, infoHash := range announce.InfoHashes {
+		fmt.Fprintf(&buffer, "Infohash: %x\r\n", infoHash)
+	}
+	if announce.Cookie != "" {
+		fmt.Fprintf(&buffer, "cookie: %v\r\n", announce.Cookie)
+	}
+	fmt.Fprintf(&buffer, "\r\n\r\n")
+	return buffer.Bytes()
+}
+
+func ParseLSDAnnounce(data []byte) (announce *LSDAnnounce, err error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return
+	}
+	if request.Method != "BT-SEARCH" {
+		err = ErrInvalidLSDMessage
+		return
+	}
+
+	announce = new(LSDAnnounce)
+	announce.Cookie = request.Header.Get("Cookie")
+	announce.Port, err = strconv.Atoi(request.Header.Get("Port"))
+	if err != nil || announce.Port <= 0 || announce.Port > 0xFFFF {
+		err = ErrInvalidLSDMessage
+		return
+	}
+
+	for _, hexHash := range request.Header["Infohash"] {
+		infoHash, err := hex.DecodeString(hexHash)
+		if err == nil && len(infoHash) == 20 {
+			announce.InfoHashes = append(announce.InfoHashes, string(infoHash))
+		}
+	}
+	if len(announce.InfoHashes) == 0 {
+		err = ErrInvalidLSDMessage
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package gotorrent
+
+import (
+	"testing"
+)
+
+func TestLSDAnnounce(t *testing.T) {
+	announce := LSDAnnounce{
+		Port:       6881,
+		InfoHashes: []string{"abcdefghij0123456789", "0123456789abcdefghij"},
+		Cookie:     "cafe",
+	}
+
+	data := announce.Marshal()
+	value, err := ParseLSDAnnounce(data)
+	if err != nil {
+		t.Fatalf("ParseLSDAnnounce(%q) returned %v", data, err)
+	}
+
+	if value.Port != announce.Port {
+		t.Errorf("value.Port == %v, want %v", value.Port, announce.Port)
+	}
+	if value.Cookie != announce.Cookie {
+		t.Errorf("value.Cookie == %v, want %v", value.Cookie, announce.Cookie)
+	}
+	if len(value.InfoHashes) != 2 || value.InfoHashes[0] != announce.InfoHashes[0] || value.InfoHashes[1] != announce.InfoHashes[1] {
+		t.Errorf("value.InfoHashes == %q, want %q", value.InfoHashes, announce.InfoHashes)
+	}
+
+	if _, err := ParseLSDAnnounce([]byte("NOTIFY * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\n\r\n")); err == nil {
+		t.Errorf("ParseLSDAnnounce(NOTIFY) should fail")
+	}
+}
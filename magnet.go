@@ -0,0 +1,73 @@
+package gotorrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+const MagnetInfoHashPrefix = "urn:btih:"
+
+var ErrInvalidMagnet = errors.New("Invalid magnet link")
+
+// Magnet is a magnet link, only the info hash is mandatory.
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>
+type Magnet struct {
+	InfoHash string
+	Name     string
+	Trackers []string
+}
+
+func ParseMagnet(uri string) (magnet *Magnet, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+
+	if u.Scheme != "magnet" {
+		err = ErrInvalidMagnet
+		return
+	}
+
+	query := u.Query()
+	magnet = new(Magnet)
+	magnet.Name = query.Get("dn")
+	magnet.Trackers = query["tr"]
+
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, MagnetInfoHashPrefix) {
+			continue
+		}
+
+		if magnet.InfoHash, err = decodeInfoHash(xt[len(MagnetInfoHashPrefix):]); err != nil {
+			return
+		}
+		return
+	}
+
+	err = ErrInvalidMagnet
+	return
+}
+
+// decodeInfoHash decodes the hex or the base32 encoding of an info hash.
+func decodeInfoHash(encoded string) (infoHash string, err error) {
+	var decoded []byte
+
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		err = ErrInvalidMagnet
+	}
+
+	if err != nil {
+		return
+	}
+
+	infoHash = string(decoded)
+	return
+}
@@ -0,0 +1,81 @@
+package gotorrent
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hexHash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+	{
+		uri := "magnet:?xt=urn:btih:" + hexHash + "&dn=Ubuntu&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Fexample.org%3A80"
+		magnet, err := ParseMagnet(uri)
+		if err != nil {
+			t.Fatalf("ParseMagnet(%v) returned %v", uri, err)
+		}
+
+		if value := hex.EncodeToString([]byte(magnet.InfoHash)); value != hexHash {
+			t.Errorf("magnet.InfoHash == %v, want %v", value, hexHash)
+		}
+
+		if expected := "Ubuntu"; magnet.Name != expected {
+			t.Errorf("magnet.Name == %v, want %v", magnet.Name, expected)
+		}
+
+		expected := []string{"http://tracker.example.com/announce", "udp://example.org:80"}
+		if len(magnet.Trackers) != len(expected) {
+			t.Fatalf("magnet.Trackers == %v, want %v", magnet.Trackers, expected)
+		}
+		for i, tracker := range expected {
+			if magnet.Trackers[i] != tracker {
+				t.Errorf("magnet.Trackers[%v] == %v, want %v", i, magnet.Trackers[i], tracker)
+			}
+		}
+	}
+
+	// Base32 encoded info hash
+	{
+		uri := "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK"
+		magnet, err := ParseMagnet(uri)
+		if err != nil {
+			t.Fatalf("ParseMagnet(%v) returned %v", uri, err)
+		}
+
+		if value := hex.EncodeToString([]byte(magnet.InfoHash)); value != hexHash {
+			t.Errorf("magnet.InfoHash == %v, want %v", value, hexHash)
+		}
+	}
+
+	for _, uri := range []string{
+		"http://example.com",
+		"magnet:?dn=Ubuntu",
+		"magnet:?xt=urn:btih:1234",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("ParseMagnet(%v) should fail", uri)
+		}
+	}
+}
+
+func TestBencodeValueLength(t *testing.T) {
+	values := map[string]int{
+		"d8:msg_typei1e5:piecei0e10:total_sizei3eeabc": 41,
+		"i42e":          4,
+		"4:spamtail":    6,
+		"l4:spami7eexx": 11,
+	}
+
+	for data, expected := range values {
+		value, err := bencodeValueLength([]byte(data))
+		if err != nil || value != expected {
+			t.Errorf("bencodeValueLength(%v) == %v, %v, want %v", data, value, err, expected)
+		}
+	}
+
+	for _, data := range []string{"", "d4:spam", "5:spam", "x"} {
+		if _, err := bencodeValueLength([]byte(data)); err == nil {
+			t.Errorf("bencodeValueLength(%v) should fail", data)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package gotorrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/moretti/gotorrent/messages"
+	"io"
+)
+
+const (
+	// ReadBufferSize holds a few Piece messages, so the messages arriving
+	// together are decoded without going back to the connection
+	ReadBufferSize = 64 * 1024
+	// MaxMessageLength bounds the variable length messages, bit fields and
+	// extended messages, it's far above what a sane peer sends
+	MaxMessageLength = 1024 * 1024
+)
+
+// messageReader decodes the length prefixed messages of a connection.
+type messageReader struct {
+	reader *bufio.Reader
+	length [4]byte
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	return &messageReader{reader: bufio.NewReaderSize(r, ReadBufferSize)}
+}
+
+// ReadMessage returns the next message, io.EOF if the connection has been
+// closed between two messages. The length is checked against the message
+// type before the payload is read.
+func (r *messageReader) ReadMessage() (message messages.Message, err error) {
+	if _, err = io.ReadFull(r.reader, r.length[:]); err != nil {
+		return
+	}
+
+	message.Header.Length = binary.BigEndian.Uint32(r.length[:])
+	if message.Header.Length == 0 {
+		// Keep alive
+		return
+	}
+
+	if message.Header.Id, err = r.reader.ReadByte(); err != nil {
+		return message, unexpectedEOF(err)
+	}
+
+	min, max := messageLengthLimits(message.Header.Id)
+	if message.Header.Length < min || message.Header.Length > max {
+		err = messages.ErrInvalidLength
+		return
+	}
+
+	// The payload is handed over to the peer manager, it can't share the buffer
+	message.Payload = make([]byte, message.Header.Length-1)
+	if _, err = io.ReadFull(r.reader, message.Payload); err != nil {
+		return message, unexpectedEOF(err)
+	}
+	return
+}
+
+// messageLengthLimits returns the shortest and the longest length,
+// id included, of a message type.
+func messageLengthLimits(id byte) (min, max uint32) {
+	switch id {
+	case messages.ChokeId:
+		return messages.ChokeLength, messages.ChokeLength
+	case messages.UnchokeId:
+		return messages.UnchokeLength, messages.UnchokeLength
+	case messages.InterestedId:
+		return messages.InterestedLength, messages.InterestedLength
+	case messages.NotInterestedId:
+		return messages.NotInterestedLength, messages.NotInterestedLength
+	case messages.HaveId:
+		return messages.HaveLength, messages.HaveLength
+	case messages.RequestId:
+		return messages.RequestLength, messages.RequestLength
+	case messages.PieceId:
+		// We never request more than a block
+		return messages.PieceLength, messages.PieceLength + MaxBlockLength
+	case messages.CancelId:
+		return messages.CancelLength, messages.CancelLength
+	case messages.PortId:
+		return messages.PortLength, messages.PortLength
+	case messages.SuggestPieceId:
+		return messages.SuggestPieceLength, messages.SuggestPieceLength
+	case messages.HaveAllId:
+		return messages.HaveAllLength, messages.HaveAllLength
+	case messages.HaveNoneId:
+		return messages.HaveNoneLength, messages.HaveNoneLength
+	case messages.RejectRequestId:
+		return messages.RejectRequestLength, messages.RejectRequestLength
+	case messages.AllowedFastId:
+		return messages.AllowedFastLength, messages.AllowedFastLength
+	case messages.ExtendedId:
+		// The extended message id comes first
+		return 2, MaxMessageLength
+	}
+	// Bit fields and unknown messages, which are ignored
+	return 1, MaxMessageLength
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
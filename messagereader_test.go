@@ -0,0 +1,68 @@
+package gotorrent
+
+import (
+	"bytes"
+	"github.com/moretti/gotorrent/messages"
+	"io"
+	"testing"
+)
+
+func TestMessageReader(t *testing.T) {
+	block := bytes.Repeat([]byte{0xab}, MaxBlockLength)
+	piece, _ := messages.NewPiece(1, 0, block).MarshalBinary()
+	have := []byte{0, 0, 0, messages.HaveLength, messages.HaveId, 0, 0, 0, 7}
+
+	data := new(bytes.Buffer)
+	data.Write(have)
+	data.Write([]byte{0, 0, 0, 0})
+	data.Write(piece)
+	data.Write(have)
+	reader := newMessageReader(data)
+
+	// A full block fits in a Piece message and every buffered message is decoded
+	for _, expected := range []messages.Header{
+		{Length: messages.HaveLength, Id: messages.HaveId},
+		{Length: 0},
+		{Length: messages.PieceLength + MaxBlockLength, Id: messages.PieceId},
+		{Length: messages.HaveLength, Id: messages.HaveId},
+	} {
+		message, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() returned %v", err)
+		}
+		if value := message.Header; value != expected {
+			t.Errorf("message.Header == %v, want %v", value, expected)
+		}
+		if value := len(message.Payload); expected.Length > 0 && value != int(expected.Length)-1 {
+			t.Errorf("len(message.Payload) == %v, want %v", value, expected.Length-1)
+		}
+	}
+
+	if _, err := reader.ReadMessage(); err != io.EOF {
+		t.Errorf("ReadMessage() returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestMessageReaderErrors(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected error
+	}{
+		// Have with a missing index
+		{[]byte{0, 0, 0, 1, messages.HaveId}, messages.ErrInvalidLength},
+		// Piece larger than a block
+		{[]byte{0, 0, 0x40, 0x0a, messages.PieceId}, messages.ErrInvalidLength},
+		// Bit field larger than MaxMessageLength
+		{[]byte{0x10, 0, 0, 0, messages.BitFieldId}, messages.ErrInvalidLength},
+		// Truncated message
+		{[]byte{0, 0, 0, 5, messages.HaveId, 0}, io.ErrUnexpectedEOF},
+		{[]byte{0, 0}, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		_, err := newMessageReader(bytes.NewReader(test.data)).ReadMessage()
+		if err != test.expected {
+			t.Errorf("ReadMessage(%x) returned %v, want %v", test.data, err, test.expected)
+		}
+	}
+}
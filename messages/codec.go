@@ -0,0 +1,502 @@
+package messages
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrUnknownMessage    = errors.New("Unknown message")
+	ErrUnexpectedMessage = errors.New("Unexpected message id")
+)
+
+// Marshal encodes a message of this package with its length prefix.
+func Marshal(message interface{}) ([]byte, error) {
+	marshaler, ok := message.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrUnknownMessage
+	}
+	return marshaler.MarshalBinary()
+}
+
+// Unmarshal decodes a message with its length prefix, it returns the type
+// Marshal has been given: *KeepAlive, *Header for the messages without
+// payload, *Have, *BitArray, *Request, *Piece and so on.
+func Unmarshal(data []byte) (message interface{}, err error) {
+	m := new(Message)
+	if err = m.UnmarshalBinary(data); err != nil {
+		return
+	}
+	return m.Decode()
+}
+
+// MarshalBinary encodes the length, the id and the payload,
+// only the length of a keep-alive.
+func (m *Message) MarshalBinary() (data []byte, err error) {
+	if m.Header.Length == 0 && len(m.Payload) == 0 {
+		return make([]byte, 4), nil
+	}
+	if m.Header.Length != 1+uint32(len(m.Payload)) {
+		return nil, ErrInvalidLength
+	}
+
+	data = make([]byte, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(data, m.Header.Length)
+	data[4] = m.Header.Id
+	copy(data[5:], m.Payload)
+	return
+}
+
+// UnmarshalBinary decodes a whole message, the payload shares data.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != uint32(len(data)-4) {
+		return ErrInvalidLength
+	}
+
+	m.Header = Header{Length: uint32(len(data) - 4)}
+	m.Payload = nil
+	if m.Header.Length > 0 {
+		m.Header.Id = data[4]
+		m.Payload = data[5:]
+	}
+	return nil
+}
+
+// Decode converts the message to its type, see Unmarshal.
+func (m *Message) Decode() (message interface{}, err error) {
+	if m.Header.Length == 0 {
+		message, err = m.ToKeepAlive()
+	} else {
+		switch m.Header.Id {
+		case ChokeId, UnchokeId, InterestedId, NotInterestedId, HaveAllId, HaveNoneId:
+			message, err = m.toHeader()
+		case HaveId:
+			message, err = m.ToHave()
+		case BitFieldId:
+			message, err = m.ToBitArray()
+		case RequestId:
+			message, err = m.ToRequest()
+		case PieceId:
+			message, err = m.ToPiece()
+		case CancelId:
+			message, err = m.ToCancel()
+		case PortId:
+			message, err = m.ToPort()
+		case SuggestPieceId:
+			message, err = m.ToSuggestPiece()
+		case RejectRequestId:
+			message, err = m.ToRejectRequest()
+		case AllowedFastId:
+			message, err = m.ToAllowedFast()
+		case ExtendedId:
+			message, err = m.ToExtended()
+		default:
+			err = ErrUnknownMessage
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// check verifies the id of the message and that its length is consistent
+// with the payload and between min and max, max is 0 when unbounded.
+func (m *Message) check(id byte, min, max uint32) error {
+	if m.Header.Id != id {
+		return ErrUnexpectedMessage
+	}
+	length := m.Header.Length
+	if length != 1+uint32(len(m.Payload)) || length < min || (max > 0 && length > max) {
+		return ErrInvalidLength
+	}
+	return nil
+}
+
+func (m *Message) ToKeepAlive() (keepAlive *KeepAlive, err error) {
+	if m.Header.Length != 0 || len(m.Payload) != 0 {
+		return nil, ErrInvalidLength
+	}
+	return NewKeepAlive(), nil
+}
+
+// toHeader converts the messages without payload.
+func (m *Message) toHeader() (header *Header, err error) {
+	switch m.Header.Id {
+	case ChokeId, UnchokeId, InterestedId, NotInterestedId, HaveAllId, HaveNoneId:
+	default:
+		return nil, ErrUnexpectedMessage
+	}
+	if err = m.check(m.Header.Id, 1, 1); err != nil {
+		return
+	}
+	header = new(Header)
+	*header = m.Header
+	return
+}
+
+func (m *Message) ToHave() (have *Have, err error) {
+	pieceIndex, err := m.toPieceIndex(HaveId, HaveLength)
+	if err != nil {
+		return
+	}
+	return NewHave(pieceIndex), nil
+}
+
+func (m *Message) ToBitArray() (bitArray *BitArray, err error) {
+	if err = m.check(BitFieldId, BitFieldLength, 0); err != nil {
+		return
+	}
+	return NewBitArray(m.Payload), nil
+}
+
+func (m *Message) ToRequest() (request *Request, err error) {
+	fields, err := m.toBlockFields(RequestId, RequestLength)
+	if err != nil {
+		return
+	}
+	return NewRequest(fields.PieceIndex, fields.BlockOffset, fields.BlockLength), nil
+}
+
+// piece: <len=0009+X><id=7><index><begin><block>
+func (m *Message) ToPiece() (piece *Piece, err error) {
+	if err = m.check(PieceId, PieceLength, 0); err != nil {
+		return
+	}
+	pieceIndex := binary.BigEndian.Uint32(m.Payload)
+	blockOffset := binary.BigEndian.Uint32(m.Payload[4:])
+	return NewPiece(pieceIndex, blockOffset, m.Payload[8:]), nil
+}
+
+func (m *Message) ToCancel() (cancel *Cancel, err error) {
+	fields, err := m.toBlockFields(CancelId, CancelLength)
+	if err != nil {
+		return
+	}
+	return NewCancel(fields.PieceIndex, fields.BlockOffset, fields.BlockLength), nil
+}
+
+func (m *Message) ToRejectRequest() (reject *RejectRequest, err error) {
+	fields, err := m.toBlockFields(RejectRequestId, RejectRequestLength)
+	if err != nil {
+		return
+	}
+	return NewRejectRequest(fields.PieceIndex, fields.BlockOffset, fields.BlockLength), nil
+}
+
+// blockFields is the payload shared by the request, cancel and reject messages
+type blockFields struct {
+	PieceIndex  uint32
+	BlockOffset uint32
+	BlockLength uint32
+}
+
+func (m *Message) toBlockFields(id byte, length uint32) (fields blockFields, err error) {
+	if err = m.check(id, length, length); err != nil {
+		return
+	}
+	fields.PieceIndex = binary.BigEndian.Uint32(m.Payload)
+	fields.BlockOffset = binary.BigEndian.Uint32(m.Payload[4:])
+	fields.BlockLength = binary.BigEndian.Uint32(m.Payload[8:])
+	return
+}
+
+func (m *Message) ToPort() (port *Port, err error) {
+	if err = m.check(PortId, PortLength, PortLength); err != nil {
+		return
+	}
+	return NewPort(binary.BigEndian.Uint16(m.Payload)), nil
+}
+
+func (m *Message) ToSuggestPiece() (suggest *SuggestPiece, err error) {
+	pieceIndex, err := m.toPieceIndex(SuggestPieceId, SuggestPieceLength)
+	if err != nil {
+		return
+	}
+	return NewSuggestPiece(pieceIndex), nil
+}
+
+func (m *Message) ToAllowedFast() (allowedFast *AllowedFast, err error) {
+	pieceIndex, err := m.toPieceIndex(AllowedFastId, AllowedFastLength)
+	if err != nil {
+		return
+	}
+	return NewAllowedFast(pieceIndex), nil
+}
+
+func (m *Message) toPieceIndex(id byte, length uint32) (pieceIndex uint32, err error) {
+	if err = m.check(id, length, length); err != nil {
+		return
+	}
+	pieceIndex = binary.BigEndian.Uint32(m.Payload)
+	return
+}
+
+func (m *Message) ToExtended() (extended *Extended, err error) {
+	if err = m.check(ExtendedId, 2, 0); err != nil {
+		return
+	}
+	return NewExtended(m.Payload[0], m.Payload[1:]), nil
+}
+
+// The typed messages are encoded through Message, so that Marshal and
+// Unmarshal go through the same checks.
+
+func (keepAlive *KeepAlive) MarshalBinary() ([]byte, error) {
+	return (&Message{Header: Header{Length: keepAlive.Length}}).MarshalBinary()
+}
+
+func (keepAlive *KeepAlive) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToKeepAlive()
+	if err == nil {
+		*keepAlive = *decoded
+	}
+	return err
+}
+
+func (header *Header) MarshalBinary() ([]byte, error) {
+	return (&Message{Header: *header}).MarshalBinary()
+}
+
+func (header *Header) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.toHeader()
+	if err == nil {
+		*header = *decoded
+	}
+	return err
+}
+
+func (have *Have) MarshalBinary() ([]byte, error) {
+	return have.Header.withPayload(uint32Bytes(have.PieceIndex)).MarshalBinary()
+}
+
+func (have *Have) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToHave()
+	if err == nil {
+		*have = *decoded
+	}
+	return err
+}
+
+func (bitArray *BitArray) MarshalBinary() ([]byte, error) {
+	return bitArray.Header.withPayload(bitArray.BitField).MarshalBinary()
+}
+
+func (bitArray *BitArray) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToBitArray()
+	if err == nil {
+		*bitArray = *decoded
+	}
+	return err
+}
+
+func (request *Request) MarshalBinary() ([]byte, error) {
+	return request.Header.withBlockFields(request.PieceIndex, request.BlockOffset, request.BlockLength).MarshalBinary()
+}
+
+func (request *Request) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToRequest()
+	if err == nil {
+		*request = *decoded
+	}
+	return err
+}
+
+// MarshalBinary writes the message straight into its final buffer, the block is copied once.
+func (piece *Piece) MarshalBinary() ([]byte, error) {
+	if piece.Header.Length != 9+uint32(len(piece.BlockData)) {
+		return nil, ErrInvalidLength
+	}
+
+	data := make([]byte, 13+len(piece.BlockData))
+	binary.BigEndian.PutUint32(data, piece.Header.Length)
+	data[4] = piece.Header.Id
+	binary.BigEndian.PutUint32(data[5:], piece.PieceIndex)
+	binary.BigEndian.PutUint32(data[9:], piece.BlockOffset)
+	copy(data[13:], piece.BlockData)
+	return data, nil
+}
+
+func (piece *Piece) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToPiece()
+	if err == nil {
+		*piece = *decoded
+	}
+	return err
+}
+
+func (cancel *Cancel) MarshalBinary() ([]byte, error) {
+	return cancel.Header.withBlockFields(cancel.PieceIndex, cancel.BlockOffset, cancel.BlockLength).MarshalBinary()
+}
+
+func (cancel *Cancel) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToCancel()
+	if err == nil {
+		*cancel = *decoded
+	}
+	return err
+}
+
+func (port *Port) MarshalBinary() ([]byte, error) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port.ListenPort)
+	return port.Header.withPayload(payload).MarshalBinary()
+}
+
+func (port *Port) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToPort()
+	if err == nil {
+		*port = *decoded
+	}
+	return err
+}
+
+func (suggest *SuggestPiece) MarshalBinary() ([]byte, error) {
+	return suggest.Header.withPayload(uint32Bytes(suggest.PieceIndex)).MarshalBinary()
+}
+
+func (suggest *SuggestPiece) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToSuggestPiece()
+	if err == nil {
+		*suggest = *decoded
+	}
+	return err
+}
+
+func (reject *RejectRequest) MarshalBinary() ([]byte, error) {
+	return reject.Header.withBlockFields(reject.PieceIndex, reject.BlockOffset, reject.BlockLength).MarshalBinary()
+}
+
+func (reject *RejectRequest) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToRejectRequest()
+	if err == nil {
+		*reject = *decoded
+	}
+	return err
+}
+
+func (allowedFast *AllowedFast) MarshalBinary() ([]byte, error) {
+	return allowedFast.Header.withPayload(uint32Bytes(allowedFast.PieceIndex)).MarshalBinary()
+}
+
+func (allowedFast *AllowedFast) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToAllowedFast()
+	if err == nil {
+		*allowedFast = *decoded
+	}
+	return err
+}
+
+func (extended *Extended) MarshalBinary() ([]byte, error) {
+	payload := make([]byte, 1+len(extended.Payload))
+	payload[0] = extended.ExtendedId
+	copy(payload[1:], extended.Payload)
+	return extended.Header.withPayload(payload).MarshalBinary()
+}
+
+func (extended *Extended) UnmarshalBinary(data []byte) error {
+	m := new(Message)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	decoded, err := m.ToExtended()
+	if err == nil {
+		*extended = *decoded
+	}
+	return err
+}
+
+// MarshalBinary encodes the handshake, which has no length prefix.
+func (hand *Handshake) MarshalBinary() ([]byte, error) {
+	if int(hand.Pstrlen) != len(hand.Pstr) {
+		return nil, ErrInvalidLength
+	}
+
+	data := make([]byte, 0, HandshakeLength)
+	data = append(data, hand.Pstrlen)
+	data = append(data, hand.Pstr[:]...)
+	data = append(data, hand.Reserved[:]...)
+	data = append(data, hand.InfoHash[:]...)
+	data = append(data, hand.PeerId[:]...)
+	return data, nil
+}
+
+func (hand *Handshake) UnmarshalBinary(data []byte) error {
+	if len(data) != HandshakeLength || int(data[0]) != len(hand.Pstr) {
+		return ErrInvalidLength
+	}
+
+	hand.Pstrlen = data[0]
+	data = data[1:]
+	data = data[copy(hand.Pstr[:], data):]
+	data = data[copy(hand.Reserved[:], data):]
+	data = data[copy(hand.InfoHash[:], data):]
+	copy(hand.PeerId[:], data)
+	return nil
+}
+
+// withPayload builds the message of a header, the length set by the
+// constructors is checked against the payload when marshaling.
+func (header *Header) withPayload(payload []byte) *Message {
+	return &Message{Header: *header, Payload: payload}
+}
+
+func (header *Header) withBlockFields(pieceIndex, blockOffset, blockLength uint32) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload, pieceIndex)
+	binary.BigEndian.PutUint32(payload[4:], blockOffset)
+	binary.BigEndian.PutUint32(payload[8:], blockLength)
+	return header.withPayload(payload)
+}
+
+func uint32Bytes(value uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return data
+}
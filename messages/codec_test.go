@@ -0,0 +1,87 @@
+package messages
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	values := []interface{}{
+		NewKeepAlive(),
+		NewChoke(),
+		NewUnchoke(),
+		NewInterested(),
+		NewNotInterested(),
+		NewHave(42),
+		NewBitArray([]byte{0xff, 0x80}),
+		NewRequest(1, 16384, 16384),
+		NewPiece(1, 16384, []byte("block")),
+		NewCancel(1, 16384, 16384),
+		NewPort(6881),
+		NewSuggestPiece(7),
+		NewHaveAll(),
+		NewHaveNone(),
+		NewRejectRequest(1, 0, 16384),
+		NewAllowedFast(3),
+		NewExtended(ExtendedHandshakeId, []byte("d1:pi6881ee")),
+	}
+
+	for _, expected := range values {
+		data, err := Marshal(expected)
+		if err != nil {
+			t.Errorf("Marshal(%#v) returned %v", expected, err)
+			continue
+		}
+
+		value, err := Unmarshal(data)
+		if err != nil {
+			t.Errorf("Unmarshal(%x) returned %v", data, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, expected) {
+			t.Errorf("Unmarshal(%x) == %#v, want %#v", data, value, expected)
+		}
+
+		if again, _ := Marshal(value); !bytes.Equal(again, data) {
+			t.Errorf("Marshal(Unmarshal(%x)) == %x", data, again)
+		}
+	}
+
+	{
+		expected := NewHandshake("abcdefghij0123456789", "-GT0001-0123456789ab")
+		data, _ := expected.MarshalBinary()
+		value := new(Handshake)
+		if err := value.UnmarshalBinary(data); err != nil || *value != *expected {
+			t.Errorf("Handshake.UnmarshalBinary(%x) == %v, %v, want %v", data, value, err, expected)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected error
+	}{
+		{[]byte{0, 0, 0}, ErrInvalidLength},
+		// The length prefix doesn't match the data
+		{[]byte{0, 0, 0, 5, HaveId, 0, 0}, ErrInvalidLength},
+		{[]byte{0, 0, 0, 2, ChokeId, 0}, ErrInvalidLength},
+		{[]byte{0, 0, 0, 3, HaveId, 0, 0}, ErrInvalidLength},
+		// A piece without its offset
+		{[]byte{0, 0, 0, 5, PieceId, 0, 0, 0, 1}, ErrInvalidLength},
+		{[]byte{0, 0, 0, 1, ExtendedId}, ErrInvalidLength},
+		{[]byte{0, 0, 0, 1, 0x42}, ErrUnknownMessage},
+	}
+
+	for _, test := range tests {
+		if _, err := Unmarshal(test.data); err != test.expected {
+			t.Errorf("Unmarshal(%x) returned %v, want %v", test.data, err, test.expected)
+		}
+	}
+
+	m := Message{Header: Header{Length: HaveLength, Id: HaveId}, Payload: []byte{0, 0, 0, 1}}
+	if _, err := m.ToPiece(); err != ErrUnexpectedMessage {
+		t.Errorf("ToPiece() returned %v, want %v", err, ErrUnexpectedMessage)
+	}
+}
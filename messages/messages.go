@@ -2,7 +2,7 @@ package messages
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
@@ -19,6 +19,22 @@ const (
 	PortId
 )
 
+// Extension Protocol, BEP 10
+const (
+	ExtendedId = 20
+	// ExtendedHandshakeId is the extended message id of the extended handshake
+	ExtendedHandshakeId = 0
+)
+
+// Fast Extension, BEP 6
+const (
+	SuggestPieceId = iota + 0x0D
+	HaveAllId
+	HaveNoneId
+	RejectRequestId
+	AllowedFastId
+)
+
 const (
 	BitTorrentProtocol  = "BitTorrent protocol"
 	HandshakeLength     = 68
@@ -26,9 +42,28 @@ const (
 	UnchokeLength       = 1
 	InterestedLength    = 1
 	NotInterestedLength = 1
+	HaveLength          = 5
+	BitFieldLength      = 1
 	RequestLength       = 13
+	PieceLength         = 9
+	CancelLength        = 13
+	PortLength          = 3
+	SuggestPieceLength  = 5
+	HaveAllLength       = 1
+	HaveNoneLength      = 1
+	RejectRequestLength = 13
+	AllowedFastLength   = 5
+
+	// FastExtensionBit is set in the last reserved byte of the handshake
+	FastExtensionBit = 0x04
+	// ExtensionProtocolBit is set in the sixth reserved byte of the handshake
+	ExtensionProtocolBit = 0x10
+	// DHTBit is set in the last reserved byte of the handshake
+	DHTBit = 0x01
 )
 
+var ErrInvalidLength = errors.New("Invalid message length")
+
 // handshake: <pstrlen><pstr><reserved><info_hash><peer_id>
 type Handshake struct {
 	Pstrlen  byte
@@ -41,7 +76,7 @@ type Handshake struct {
 func NewHandshake(infoHash, peerId string) *Handshake {
 	h := Handshake{
 		Pstrlen:  byte(len(BitTorrentProtocol)),
-		Reserved: [...]byte{0, 0, 0, 0, 0, 0, 0, 0},
+		Reserved: [...]byte{0, 0, 0, 0, 0, ExtensionProtocolBit, 0, FastExtensionBit},
 	}
 	// TODO: Is there a better way to convert a string to a byte array?
 	copy(h.Pstr[:], BitTorrentProtocol)
@@ -51,6 +86,18 @@ func NewHandshake(infoHash, peerId string) *Handshake {
 	return &h
 }
 
+func (hand *Handshake) SupportsFast() bool {
+	return hand.Reserved[7]&FastExtensionBit != 0
+}
+
+func (hand *Handshake) SupportsExtensions() bool {
+	return hand.Reserved[5]&ExtensionProtocolBit != 0
+}
+
+func (hand *Handshake) SupportsDHT() bool {
+	return hand.Reserved[7]&DHTBit != 0
+}
+
 func (hand *Handshake) String() string {
 	var buffer = new(bytes.Buffer)
 
@@ -75,6 +122,24 @@ type Message struct {
 	Payload []byte
 }
 
+// keep-alive: <len=0000>
+type KeepAlive struct {
+	Length uint32
+}
+
+func NewKeepAlive() *KeepAlive {
+	return &KeepAlive{Length: 0}
+}
+
+// choke: <len=0001><id=0>
+func NewChoke() *Header {
+	c := Header{
+		Length: ChokeLength,
+		Id:     ChokeId,
+	}
+	return &c
+}
+
 // unchoke: <len=0001><id=1>
 func NewUnchoke() *Header {
 	u := Header{
@@ -108,12 +173,34 @@ type Have struct {
 	PieceIndex uint32
 }
 
+func NewHave(pieceIndex uint32) *Have {
+	h := Have{
+		Header: Header{
+			Length: HaveLength,
+			Id:     HaveId,
+		},
+		PieceIndex: pieceIndex,
+	}
+	return &h
+}
+
 // bitArray: <len=0001+X><id=5><bitArray>
 type BitArray struct {
 	Header   Header
 	BitField []byte
 }
 
+func NewBitArray(bitField []byte) *BitArray {
+	b := BitArray{
+		Header: Header{
+			Length: BitFieldLength + uint32(len(bitField)),
+			Id:     BitFieldId,
+		},
+		BitField: bitField,
+	}
+	return &b
+}
+
 // request: <len=0013><id=6><index><begin><length>
 type Request struct {
 	Header      Header
@@ -143,6 +230,19 @@ type Piece struct {
 	BlockData   []byte
 }
 
+func NewPiece(pieceIndex, blockOffset uint32, blockData []byte) *Piece {
+	p := Piece{
+		Header: Header{
+			Length: PieceLength + uint32(len(blockData)),
+			Id:     PieceId,
+		},
+		PieceIndex:  pieceIndex,
+		BlockOffset: blockOffset,
+		BlockData:   blockData,
+	}
+	return &p
+}
+
 // cancel: <len=0013><id=8><index><begin><length>
 type Cancel struct {
 	Header      Header
@@ -151,26 +251,124 @@ type Cancel struct {
 	BlockLength uint32
 }
 
-func (m *Message) ToHave() (have *Have, err error) {
-	have = new(Have)
-	have.Header = m.Header
-	err = binary.Read(bytes.NewBuffer(m.Payload), binary.BigEndian, &have.PieceIndex)
-	return
+func NewCancel(pieceIndex, blockOffset, blockLength uint32) *Cancel {
+	c := Cancel{
+		Header: Header{
+			Length: CancelLength,
+			Id:     CancelId,
+		},
+		PieceIndex:  pieceIndex,
+		BlockOffset: blockOffset,
+		BlockLength: blockLength,
+	}
+	return &c
 }
 
-func (m *Message) ToBitArray() (bitArray *BitArray, err error) {
-	bitArray = new(BitArray)
-	bitArray.Header = m.Header
-	bitArray.BitField = m.Payload
-	return
+// port: <len=0003><id=9><listen-port>
+type Port struct {
+	Header     Header
+	ListenPort uint16
 }
 
-func (m *Message) ToPiece() (piece *Piece, err error) {
-	piece = new(Piece)
-	piece.Header = m.Header
-	// piece: <len=0009+X><id=7><index><begin><block>
-	err = binary.Read(bytes.NewBuffer(m.Payload[:4]), binary.BigEndian, &piece.PieceIndex)
-	err = binary.Read(bytes.NewBuffer(m.Payload[4:8]), binary.BigEndian, &piece.BlockOffset)
-	piece.BlockData = m.Payload[8:]
-	return
+func NewPort(listenPort uint16) *Port {
+	p := Port{
+		Header: Header{
+			Length: PortLength,
+			Id:     PortId,
+		},
+		ListenPort: listenPort,
+	}
+	return &p
+}
+
+// suggest piece: <len=0005><id=0x0D><piece index>
+type SuggestPiece struct {
+	Header     Header
+	PieceIndex uint32
+}
+
+func NewSuggestPiece(pieceIndex uint32) *SuggestPiece {
+	s := SuggestPiece{
+		Header: Header{
+			Length: SuggestPieceLength,
+			Id:     SuggestPieceId,
+		},
+		PieceIndex: pieceIndex,
+	}
+	return &s
+}
+
+// have all: <len=0001><id=0x0E>
+func NewHaveAll() *Header {
+	h := Header{
+		Length: HaveAllLength,
+		Id:     HaveAllId,
+	}
+	return &h
+}
+
+// have none: <len=0001><id=0x0F>
+func NewHaveNone() *Header {
+	h := Header{
+		Length: HaveNoneLength,
+		Id:     HaveNoneId,
+	}
+	return &h
+}
+
+// reject request: <len=0013><id=0x10><index><begin><length>
+type RejectRequest struct {
+	Header      Header
+	PieceIndex  uint32
+	BlockOffset uint32
+	BlockLength uint32
+}
+
+func NewRejectRequest(pieceIndex, blockOffset, blockLength uint32) *RejectRequest {
+	r := RejectRequest{
+		Header: Header{
+			Length: RejectRequestLength,
+			Id:     RejectRequestId,
+		},
+		PieceIndex:  pieceIndex,
+		BlockOffset: blockOffset,
+		BlockLength: blockLength,
+	}
+	return &r
+}
+
+// allowed fast: <len=0005><id=0x11><piece index>
+type AllowedFast struct {
+	Header     Header
+	PieceIndex uint32
+}
+
+func NewAllowedFast(pieceIndex uint32) *AllowedFast {
+	a := AllowedFast{
+		Header: Header{
+			Length: AllowedFastLength,
+			Id:     AllowedFastId,
+		},
+		PieceIndex: pieceIndex,
+	}
+	return &a
+}
+
+// extended: <len=0002+X><id=20><extended id><payload>
+type Extended struct {
+	Header     Header
+	ExtendedId byte
+	Payload    []byte
+}
+
+func NewExtended(extendedId byte, payload []byte) *Extended {
+	e := Extended{
+		Header: Header{
+			Length: 2 + uint32(len(payload)),
+			Id:     ExtendedId,
+		},
+		ExtendedId: extendedId,
+		Payload:    payload,
+	}
+	return &e
 }
@@ -0,0 +1,411 @@
+package gotorrent
+
+import (
+	"bytes"
+	log "code.google.com/p/tcgl/applog"
+	"crypto/sha1"
+	"errors"
+	"github.com/moretti/gotorrent/metainfo"
+	"time"
+)
+
+const (
+	MetadataExtensionName = "ut_metadata"
+	// MetadataPieceLength is the size of every metadata piece but the last one
+	MetadataPieceLength = 16 * 1024
+	// MaxMetadataSize protects us from peers advertising huge info dictionaries
+	MaxMetadataSize = 8 * 1024 * 1024
+	// MetadataRequestTimeout is how long we wait for a metadata piece before asking another peer
+	MetadataRequestTimeout = 30 * time.Second
+)
+
+// Message types of the Metadata Extension
+const (
+	metadataRequestType = 0
+	metadataDataType    = 1
+	metadataRejectType  = 2
+)
+
+var (
+	ErrInvalidMetadataMessage = errors.New("Invalid metadata message")
+	ErrInvalidBencode         = errors.New("Invalid bencoded value")
+)
+
+func init() {
+	RegisterExtension(func(pm *PeerManager) Extension {
+		return NewMetadataExtension(pm)
+	})
+}
+
+// MetadataExtension implements the Metadata Extension (BEP 9),
+// it downloads the info dictionary of a magnet link and serves ours to the other peers.
+type MetadataExtension struct {
+	pm *PeerManager
+
+	// size is the size we download, sizes holds the one announced by every peer
+	size      int
+	sizes     map[*Peer]int
+	data      []byte
+	received  []bool
+	requests  []*metadataRequest
+	rejecters map[*Peer]bool
+}
+
+type metadataRequest struct {
+	peer *Peer
+	sent time.Time
+}
+
+func NewMetadataExtension(pm *PeerManager) *MetadataExtension {
+	e := new(MetadataExtension)
+	e.pm = pm
+	e.sizes = make(map[*Peer]int)
+	e.rejecters = make(map[*Peer]bool)
+	return e
+}
+
+func (e *MetadataExtension) Name() string {
+	return MetadataExtensionName
+}
+
+func (e *MetadataExtension) ExtendHandshake(handshake map[string]interface{}) {
+	if e.pm.Torrent.HasMetadata() {
+		handshake["metadata_size"] = len(e.pm.Torrent.InfoBytes)
+	}
+}
+
+func (e *MetadataExtension) PeerHandshake(peer *Peer, handshake *ExtendedHandshake) {
+	if e.pm.Torrent.HasMetadata() {
+		return
+	}
+
+	size := handshake.MetadataSize
+	if size <= 0 || size > MaxMetadataSize {
+		log.Debugf("Peer %v - Invalid metadata size: %v", peer.String(), size)
+		return
+	}
+
+	e.sizes[peer] = size
+	if e.size == 0 {
+		e.chooseSize()
+	}
+
+	e.requestPieces(peer, time.Now())
+}
+
+// chooseSize starts over with the size announced by most of the peers we can download from.
+func (e *MetadataExtension) chooseSize() {
+	counts := make(map[int]int)
+	for peer, size := range e.sizes {
+		if !e.rejecters[peer] {
+			counts[size]++
+		}
+	}
+
+	size := 0
+	for candidate, count := range counts {
+		if count > counts[size] {
+			size = candidate
+		}
+	}
+
+	e.reset()
+	if size == 0 {
+		return
+	}
+
+	log.Debugf("Metadata size: %v", size)
+	e.size = size
+	pieceCount := (size + MetadataPieceLength - 1) / MetadataPieceLength
+	e.data = make([]byte, size)
+	e.received = make([]bool, pieceCount)
+	e.requests = make([]*metadataRequest, pieceCount)
+}
+
+// dropSize forgets a size which didn't give the expected metadata and tries the next one.
+func (e *MetadataExtension) dropSize(now time.Time) {
+	for peer, size := range e.sizes {
+		if size == e.size {
+			delete(e.sizes, peer)
+		}
+	}
+
+	e.chooseSize()
+	for peer := range e.sizes {
+		e.requestPieces(peer, now)
+	}
+}
+
+func (e *MetadataExtension) HandleMessage(peer *Peer, payload []byte) error {
+	n, err := bencodeValueLength(payload)
+	if err != nil {
+		return err
+	}
+
+	dict, err := decodeDict(payload[:n])
+	if err != nil {
+		return err
+	}
+
+	msgType, ok := dict["msg_type"].(int64)
+	if !ok {
+		return ErrInvalidMetadataMessage
+	}
+	piece, ok := dict["piece"].(int64)
+	if !ok || piece < 0 {
+		return ErrInvalidMetadataMessage
+	}
+
+	switch msgType {
+	case metadataRequestType:
+		e.serveRequest(peer, int(piece))
+	case metadataDataType:
+		totalSize, _ := dict["total_size"].(int64)
+		return e.processData(peer, int(piece), int(totalSize), payload[n:])
+	case metadataRejectType:
+		log.Debugf("Peer %v - Metadata piece #%v rejected", peer.String(), piece)
+		e.rejecters[peer] = true
+		if int(piece) < len(e.requests) && e.requests[piece] != nil && e.requests[piece].peer == peer {
+			e.requests[piece] = nil
+		}
+	}
+	// Unknown message types must be ignored
+	return nil
+}
+
+// Tick asks the other peers for the pieces which haven't arrived in time,
+// and for another size once nobody is left to download the current one from.
+func (e *MetadataExtension) Tick(now time.Time) {
+	if e.pm.Torrent.HasMetadata() {
+		return
+	}
+
+	for peer := range e.sizes {
+		if e.pm.Peers[peer.String()] != peer {
+			delete(e.sizes, peer)
+		}
+	}
+	for peer := range e.rejecters {
+		if e.pm.Peers[peer.String()] != peer {
+			delete(e.rejecters, peer)
+		}
+	}
+
+	available := false
+	for peer, size := range e.sizes {
+		if size == e.size && !e.rejecters[peer] {
+			available = true
+		}
+	}
+	if !available {
+		e.chooseSize()
+	}
+	if e.size == 0 {
+		return
+	}
+
+	for piece, request := range e.requests {
+		if request == nil {
+			continue
+		}
+		if e.pm.Peers[request.peer.String()] != request.peer || now.Sub(request.sent) > MetadataRequestTimeout {
+			e.requests[piece] = nil
+		}
+	}
+
+	for peer := range e.sizes {
+		e.requestPieces(peer, now)
+	}
+}
+
+// requestPieces asks the peer for every missing piece nobody has been asked for.
+func (e *MetadataExtension) requestPieces(peer *Peer, now time.Time) {
+	if e.rejecters[peer] || e.sizes[peer] != e.size {
+		return
+	}
+
+	for piece, received := range e.received {
+		if received || e.requests[piece] != nil {
+			continue
+		}
+
+		if !e.send(peer, map[string]interface{}{"msg_type": metadataRequestType, "piece": piece}, nil) {
+			return
+		}
+		e.requests[piece] = &metadataRequest{peer, now}
+	}
+}
+
+func (e *MetadataExtension) serveRequest(peer *Peer, piece int) {
+	infoBytes := e.pm.Torrent.InfoBytes
+	begin := piece * MetadataPieceLength
+
+	if !e.pm.Torrent.HasMetadata() || begin >= len(infoBytes) {
+		e.send(peer, map[string]interface{}{"msg_type": metadataRejectType, "piece": piece}, nil)
+		return
+	}
+
+	end := begin + MetadataPieceLength
+	if end > len(infoBytes) {
+		end = len(infoBytes)
+	}
+
+	dict := map[string]interface{}{
+		"msg_type":   metadataDataType,
+		"piece":      piece,
+		"total_size": len(infoBytes),
+	}
+	e.send(peer, dict, []byte(infoBytes[begin:end]))
+}
+
+func (e *MetadataExtension) processData(peer *Peer, piece, totalSize int, data []byte) error {
+	if e.pm.Torrent.HasMetadata() || e.size == 0 {
+		return nil
+	}
+
+	// The pieces are numbered after the size announced in the extended handshake
+	if totalSize != e.size || piece >= len(e.received) {
+		return ErrInvalidMetadataMessage
+	}
+
+	begin := piece * MetadataPieceLength
+	end := begin + MetadataPieceLength
+	if end > e.size {
+		end = e.size
+	}
+	if len(data) != end-begin {
+		return ErrInvalidMetadataMessage
+	}
+
+	log.Debugf("Peer %v - Metadata piece #%v", peer.String(), piece)
+	copy(e.data[begin:end], data)
+	e.received[piece] = true
+	e.requests[piece] = nil
+
+	for _, received := range e.received {
+		if !received {
+			return nil
+		}
+	}
+
+	e.verify(time.Now())
+	return nil
+}
+
+// verify checks the downloaded info dictionary against the info hash,
+// the download starts over with another size if it doesn't match.
+func (e *MetadataExtension) verify(now time.Time) {
+	hash := sha1.Sum(e.data)
+	if string(hash[:]) != e.pm.Torrent.InfoHash {
+		log.Errorf("Invalid metadata, the info hash doesn't match")
+		e.dropSize(now)
+		return
+	}
+
+	info, err := metainfo.ReadInfo(e.data)
+	if err != nil {
+		log.Errorf("Unable to decode the metadata: %v", err)
+		e.dropSize(now)
+		return
+	}
+
+	if err = e.pm.applyMetadata(info, string(e.data)); err != nil {
+		log.Errorf("Unable to apply the metadata: %v", err)
+		e.dropSize(now)
+		return
+	}
+
+	e.data = nil
+	e.received = nil
+	e.requests = nil
+	e.sizes = nil
+}
+
+func (e *MetadataExtension) reset() {
+	e.size = 0
+	e.data = nil
+	e.received = nil
+	e.requests = nil
+}
+
+func (e *MetadataExtension) send(peer *Peer, dict map[string]interface{}, data []byte) bool {
+	payload, err := encodeDict(dict)
+	if err != nil {
+		log.Errorf("Peer %v - Unable to encode the metadata message: %v", peer.String(), err)
+		return false
+	}
+	return peer.SendExtension(MetadataExtensionName, append(payload, data...))
+}
+
+// applyMetadata initializes the torrent of a magnet link once its info dictionary is known,
+// the pieces announced by the peers so far are then taken into account.
+func (pm *PeerManager) applyMetadata(info *metainfo.InfoDict, infoBytes string) error {
+	if err := pm.Torrent.SetInfo(info, infoBytes); err != nil {
+		return err
+	}
+	log.Debugf("Metadata received: %v", pm.Torrent.Name)
+
+	pm.picker = NewPiecePicker(pm.Torrent.PieceCount, pm.Torrent.FileEnds())
+	for _, peer := range pm.Peers {
+		peer.ApplyMetadata()
+		pm.picker.AddBitField(peer.BitField())
+
+		if peer.SupportsFast() {
+			for _, index := range allowedFastSet(peer.connection.addr.IP, pm.Torrent.InfoHash, pm.Torrent.PieceCount, AllowedFastSetSize) {
+				peer.GrantFast(index)
+			}
+		}
+	}
+
+	for _, peer := range pm.Peers {
+		pm.requestBlocks(peer)
+	}
+	return nil
+}
+
+// bencodeValueLength returns the length of the bencoded value at the start of data,
+// the data message of the Metadata Extension appends the piece to a dictionary.
+func bencodeValueLength(data []byte) (n int, err error) {
+	if len(data) == 0 {
+		return 0, ErrInvalidBencode
+	}
+
+	switch c := data[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return 0, ErrInvalidBencode
+		}
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		n = 1
+		for n < len(data) && data[n] != 'e' {
+			length, err := bencodeValueLength(data[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += length
+		}
+		if n >= len(data) {
+			return 0, ErrInvalidBencode
+		}
+		return n + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return 0, ErrInvalidBencode
+		}
+		length := 0
+		for _, digit := range data[:colon] {
+			if digit < '0' || digit > '9' || length > len(data) {
+				return 0, ErrInvalidBencode
+			}
+			length = length*10 + int(digit-'0')
+		}
+		if colon+1+length > len(data) {
+			return 0, ErrInvalidBencode
+		}
+		return colon + 1 + length, nil
+	}
+	return 0, ErrInvalidBencode
+}
@@ -0,0 +1,178 @@
+package gotorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/moretti/gotorrent/messages"
+	"testing"
+	"time"
+)
+
+func TestMetadataExchange(t *testing.T) {
+	// Enough pieces for the info dictionary to span two metadata pieces
+	info, infoBytes := testInfo(make([]byte, 1200*1024), 1024)
+	hash := sha1.Sum(infoBytes)
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(hash[:])
+
+	addPeer := func(e *MetadataExtension, addr string, size int) *Peer {
+		peer := newTestPeer(e.pm, addr)
+		peer.SetExtendedHandshake(&ExtendedHandshake{
+			M:            map[string]byte{MetadataExtensionName: 3},
+			MetadataSize: size,
+		})
+		e.PeerHandshake(peer, peer.ExtendedHandshake)
+		return peer
+	}
+
+	// newMagnet returns the extension of a magnet link with a first peer announcing size
+	newMagnet := func(size int) (*MetadataExtension, *Peer) {
+		torrent, err := NewTorrent(NewClientId(), 6881, uri, ".", NewConnectionLimiter(DefaultMaxConnections, DefaultMaxHalfOpen))
+		if err != nil {
+			t.Fatalf("NewTorrent(%v) returned %v", uri, err)
+		}
+
+		var e *MetadataExtension
+		for _, extension := range torrent.PeerManager.extensions {
+			if metadata, ok := extension.(*MetadataExtension); ok {
+				e = metadata
+			}
+		}
+		return e, addPeer(e, "10.0.0.1:6881", size)
+	}
+
+	dataMessage := func(piece, totalSize int, data []byte) []byte {
+		payload, _ := encodeDict(map[string]interface{}{
+			"msg_type":   metadataDataType,
+			"piece":      piece,
+			"total_size": totalSize,
+		})
+		begin := piece * MetadataPieceLength
+		end := begin + MetadataPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		return append(payload, data[begin:end]...)
+	}
+
+	// Both pieces are requested, and assembled whatever the order they arrive in
+	{
+		e, peer := newMagnet(len(infoBytes))
+		torrent := e.pm.Torrent
+
+		sent := sentMessages(t, peer)
+		if len(sent) != 2 {
+			t.Fatalf("%v messages sent, want 2 requests", len(sent))
+		}
+		for piece, message := range sent {
+			extended, ok := message.(*messages.Extended)
+			if !ok || extended.ExtendedId != 3 {
+				t.Fatalf("Sent %#v, want an ut_metadata message", message)
+			}
+			dict, _ := decodeDict(extended.Payload)
+			if dictInt(dict, "msg_type") != metadataRequestType || dictInt(dict, "piece") != piece {
+				t.Errorf("Sent %v, want a request for piece #%v", dict, piece)
+			}
+		}
+
+		if err := e.HandleMessage(peer, dataMessage(1, len(infoBytes), infoBytes)); err != nil {
+			t.Fatalf("HandleMessage() returned %v", err)
+		}
+		if torrent.HasMetadata() {
+			t.Fatalf("HasMetadata() == true with a missing piece")
+		}
+		if err := e.HandleMessage(peer, dataMessage(0, len(infoBytes), infoBytes)); err != nil {
+			t.Fatalf("HandleMessage() returned %v", err)
+		}
+		if !torrent.HasMetadata() || torrent.PieceCount != len(info.Pieces)/20 {
+			t.Fatalf("HasMetadata() == %v with %v pieces, want true with %v pieces",
+				torrent.HasMetadata(), torrent.PieceCount, len(info.Pieces)/20)
+		}
+
+		// Our metadata is now served to the other peers
+		request, _ := encodeDict(map[string]interface{}{"msg_type": metadataRequestType, "piece": 1})
+		e.HandleMessage(peer, request)
+		request, _ = encodeDict(map[string]interface{}{"msg_type": metadataRequestType, "piece": 2})
+		e.HandleMessage(peer, request)
+
+		sent = sentMessages(t, peer)
+		if len(sent) != 2 {
+			t.Fatalf("%v messages sent, want a piece and a reject", len(sent))
+		}
+		if extended, ok := sent[0].(*messages.Extended); !ok || !bytes.Equal(extended.Payload, dataMessage(1, len(infoBytes), infoBytes)) {
+			t.Errorf("Sent %#v, want the metadata piece #1", sent[0])
+		}
+		if extended, ok := sent[1].(*messages.Extended); ok {
+			if dict, _ := decodeDict(extended.Payload); dictInt(dict, "msg_type") != metadataRejectType {
+				t.Errorf("Sent %v, want a reject", dict)
+			}
+		}
+	}
+
+	// The download starts over if the metadata doesn't match the info hash
+	{
+		e, peer := newMagnet(len(infoBytes))
+		corrupted := append([]byte(nil), infoBytes...)
+		corrupted[len(corrupted)-1] ^= 0xff
+
+		e.HandleMessage(peer, dataMessage(0, len(infoBytes), corrupted))
+		e.HandleMessage(peer, dataMessage(1, len(infoBytes), corrupted))
+		if e.pm.Torrent.HasMetadata() || e.size != 0 {
+			t.Errorf("HasMetadata() == %v, size == %v after a hash mismatch, want false, 0", e.pm.Torrent.HasMetadata(), e.size)
+		}
+	}
+
+	// The pieces are numbered after the size of the extended handshake
+	{
+		e, peer := newMagnet(len(infoBytes))
+		err := e.HandleMessage(peer, dataMessage(0, len(infoBytes)+MetadataPieceLength, infoBytes))
+		if err != ErrInvalidMetadataMessage || e.received[0] {
+			t.Errorf("HandleMessage() returned %v with an invalid total size, want %v", err, ErrInvalidMetadataMessage)
+		}
+	}
+
+	// A rejected piece is asked to someone else
+	{
+		e, peer := newMagnet(len(infoBytes))
+		reject, _ := encodeDict(map[string]interface{}{"msg_type": metadataRejectType, "piece": 0})
+		e.HandleMessage(peer, reject)
+		if e.requests[0] != nil || !e.rejecters[peer] {
+			t.Errorf("requests[0] == %v, rejecters[peer] == %v after a reject, want nil, true", e.requests[0], e.rejecters[peer])
+		}
+	}
+	// The size of a lying peer is dropped once its metadata fails the info hash check
+	{
+		e, liar := newMagnet(len(infoBytes) + 1)
+		honest := addPeer(e, "10.0.0.2:6881", len(infoBytes))
+		if e.size != len(infoBytes)+1 {
+			t.Fatalf("size == %v, want the size of the first peer %v", e.size, len(infoBytes)+1)
+		}
+
+		lie := make([]byte, len(infoBytes)+1)
+		for piece := range e.received {
+			e.HandleMessage(liar, dataMessage(piece, len(lie), lie))
+		}
+		if e.size != len(infoBytes) || len(sentMessages(t, honest)) != 2 {
+			t.Fatalf("size == %v after a hash mismatch, want %v requested to the other peer", e.size, len(infoBytes))
+		}
+
+		for piece := range e.received {
+			e.HandleMessage(honest, dataMessage(piece, len(infoBytes), infoBytes))
+		}
+		if !e.pm.Torrent.HasMetadata() {
+			t.Errorf("HasMetadata() == false with the metadata of the honest peer")
+		}
+	}
+
+	// The size is dropped once nobody announcing it is left
+	{
+		e, gone := newMagnet(len(infoBytes) + 1)
+		peer := addPeer(e, "10.0.0.2:6881", len(infoBytes))
+
+		delete(e.pm.Peers, gone.String())
+		e.Tick(time.Now())
+		if e.size != len(infoBytes) || len(sentMessages(t, peer)) != 2 {
+			t.Errorf("size == %v after the peer left, want %v requested to the other peer", e.size, len(infoBytes))
+		}
+	}
+}
@@ -5,14 +5,18 @@ import (
 	"code.google.com/p/bencode-go"
 	log "code.google.com/p/tcgl/applog"
 	"crypto/sha1"
+	"errors"
 	"io"
 	"os"
 )
 
+var ErrInvalidTorrent = errors.New("Invalid torrent file")
+
 // https://wiki.theory.org/BitTorrentSpecification#Metainfo_File_Structure
 type MetaInfo struct {
 	Info         InfoDict
 	InfoHash     string "info hash"
+	InfoBytes    string "info bytes"
 	Announce     string
 	AnnounceList string "announce-list"
 	CreationDate int    "creation date"
@@ -49,43 +53,50 @@ func Read(file *os.File) (metaInfo *MetaInfo, err error) {
 		return
 	}
 
-	metaInfo.InfoHash = calculateInfoHash(file)
-	log.Debugf("Info hash: %v", metaInfo.InfoHash)
-
+	metaInfo.InfoHash, metaInfo.InfoBytes, err = calculateInfoHash(file)
 	if err != nil {
 		return
 	}
+	log.Debugf("Info hash: %v", metaInfo.InfoHash)
 
 	return
 }
 
-func calculateInfoHash(file io.Reader) (infoHash string) {
+func calculateInfoHash(file io.Reader) (infoHash, infoBytes string, err error) {
 	result, err := bencode.Decode(file)
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	metaInfoMap, ok := result.(map[string]interface{})
 	if !ok {
-		panic("Couldn't parse torrent file")
+		err = ErrInvalidTorrent
+		return
 	}
 
 	infoMap, ok := metaInfoMap["info"]
 	if !ok {
-		panic("Couldn't parse torrent info file.")
+		err = ErrInvalidTorrent
+		return
 	}
 
 	var b bytes.Buffer
-	err = bencode.Marshal(&b, infoMap)
-
-	if err != nil {
-		panic(err)
+	if err = bencode.Marshal(&b, infoMap); err != nil {
+		return
 	}
 
 	hash := sha1.New()
 	hash.Write(b.Bytes())
 
 	infoHash = string(hash.Sum(nil))
+	infoBytes = b.String()
+
+	return
+}
 
+// ReadInfo decodes a bencoded info dictionary, i.e. one received from a peer.
+func ReadInfo(infoBytes []byte) (info *InfoDict, err error) {
+	info = new(InfoDict)
+	err = bencode.Unmarshal(bytes.NewReader(infoBytes), info)
 	return
 }
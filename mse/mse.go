@@ -0,0 +1,415 @@
+// Package mse implements Message Stream Encryption, the obfuscation of the
+// BitTorrent protocol through a Diffie-Hellman key exchange and RC4.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Policy tells whether connections are encrypted.
+type Policy int
+
+const (
+	// Disabled only allows plaintext connections
+	Disabled Policy = iota
+	// Preferred encrypts when the other peer supports it
+	Preferred
+	// Required refuses plaintext connections
+	Required
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "Disabled"
+	case Preferred:
+		return "Preferred"
+	case Required:
+		return "Required"
+	}
+	return "Unknown"
+}
+
+// Crypto methods, offered in crypto_provide and chosen in crypto_select
+const (
+	CryptoPlaintext = 0x01
+	CryptoRC4       = 0x02
+)
+
+const (
+	keyLength = 96
+	// maxPadLength is the maximum length of the random paddings
+	maxPadLength = 512
+	// HandshakeTimeout bounds the whole key exchange
+	HandshakeTimeout = 10 * time.Second
+	// rc4Discard is the number of bytes of the key stream which are thrown away
+	rc4Discard      = 1024
+	protocolHeader  = "\x13BitTorrent protocol"
+	verificationLen = 8
+)
+
+var (
+	ErrEncryptionDisabled = errors.New("Encrypted connections are disabled")
+	ErrPlaintextRejected  = errors.New("Plaintext connections are not allowed")
+	ErrSyncNotFound       = errors.New("Unable to synchronize with the encrypted stream")
+	ErrUnknownInfoHash    = errors.New("Unknown info hash")
+	ErrInvalidVC          = errors.New("Invalid verification constant")
+	ErrNoCommonCrypto     = errors.New("No common crypto method")
+	ErrInvalidPadLength   = errors.New("Invalid padding length")
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+)
+
+// Conn is a connection whose handshake has been negotiated,
+// the payload is RC4 encrypted if Encrypted is true.
+type Conn struct {
+	net.Conn
+	reader    io.Reader
+	decrypter *rc4.Cipher
+	encrypter *rc4.Cipher
+	writeLock sync.Mutex
+}
+
+func (c *Conn) Encrypted() bool {
+	return c.encrypter != nil
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	n, err = c.reader.Read(b)
+	if c.decrypter != nil {
+		c.decrypter.XORKeyStream(b[:n], b[:n])
+	}
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if c.encrypter == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	encrypted := make([]byte, len(b))
+	c.encrypter.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+// Initiate runs the handshake of the connecting side, infoHash is the shared secret.
+// With the Disabled policy the connection is returned as is.
+func Initiate(conn net.Conn, infoHash string, policy Policy) (c *Conn, err error) {
+	c = &Conn{Conn: conn, reader: conn}
+	if policy == Disabled {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	c.reader = reader
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	private, public := newKeyPair()
+	if _, err = conn.Write(append(public, randomPad()...)); err != nil {
+		return
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	remote := make([]byte, keyLength)
+	if _, err = io.ReadFull(reader, remote); err != nil {
+		return
+	}
+	secret := sharedSecret(private, remote)
+
+	encrypter := newCipher(hash("keyA", secret, infoHash))
+	decrypter := newCipher(hash("keyB", secret, infoHash))
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	provide := uint32(CryptoRC4)
+	if policy == Preferred {
+		provide |= CryptoPlaintext
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(hash("req1", secret))
+	buffer.Write(xor(hash("req2", infoHash), hash("req3", secret)))
+
+	var payload bytes.Buffer
+	payload.Write(make([]byte, verificationLen))
+	binary.Write(&payload, binary.BigEndian, provide)
+	binary.Write(&payload, binary.BigEndian, uint16(0))
+	binary.Write(&payload, binary.BigEndian, uint16(0))
+	encrypted := payload.Bytes()
+	encrypter.XORKeyStream(encrypted, encrypted)
+	buffer.Write(encrypted)
+
+	if _, err = conn.Write(buffer.Bytes()); err != nil {
+		return
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	vc := make([]byte, verificationLen)
+	decrypter.XORKeyStream(vc, vc)
+	if err = synchronize(reader, vc, maxPadLength+verificationLen); err != nil {
+		return
+	}
+
+	header := make([]byte, 6)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	decrypter.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header)
+	padLength := int(binary.BigEndian.Uint16(header[4:]))
+	if padLength > maxPadLength {
+		err = ErrInvalidPadLength
+		return
+	}
+	pad := make([]byte, padLength)
+	if _, err = io.ReadFull(reader, pad); err != nil {
+		return
+	}
+	decrypter.XORKeyStream(pad, pad)
+
+	switch {
+	case selected == CryptoRC4:
+		c.encrypter, c.decrypter = encrypter, decrypter
+	case selected == CryptoPlaintext && policy == Preferred:
+	default:
+		err = ErrNoCommonCrypto
+	}
+	return
+}
+
+// Accept detects whether an incoming connection is encrypted and runs the
+// handshake of the receiving side, infoHashes are the secrets we accept.
+func Accept(conn net.Conn, infoHashes []string, policy Policy) (c *Conn, err error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	c = &Conn{Conn: conn, reader: reader}
+
+	header, err := reader.Peek(len(protocolHeader))
+	if err != nil {
+		return
+	}
+	if string(header) == protocolHeader {
+		if policy == Required {
+			err = ErrPlaintextRejected
+		}
+		return
+	}
+	if policy == Disabled {
+		err = ErrEncryptionDisabled
+		return
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	remote := make([]byte, keyLength)
+	if _, err = io.ReadFull(reader, remote); err != nil {
+		return
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	private, public := newKeyPair()
+	if _, err = conn.Write(append(public, randomPad()...)); err != nil {
+		return
+	}
+	secret := sharedSecret(private, remote)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	if err = synchronize(reader, hash("req1", secret), maxPadLength+sha1.Size); err != nil {
+		return
+	}
+
+	skeyHash := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(reader, skeyHash); err != nil {
+		return
+	}
+	skeyHash = xor(skeyHash, hash("req3", secret))
+
+	infoHash := ""
+	for _, candidate := range infoHashes {
+		if bytes.Equal(skeyHash, hash("req2", candidate)) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == "" {
+		err = ErrUnknownInfoHash
+		return
+	}
+
+	decrypter := newCipher(hash("keyA", secret, infoHash))
+	encrypter := newCipher(hash("keyB", secret, infoHash))
+
+	fields := make([]byte, verificationLen+4+2)
+	if _, err = io.ReadFull(reader, fields); err != nil {
+		return
+	}
+	decrypter.XORKeyStream(fields, fields)
+	if !bytes.Equal(fields[:verificationLen], make([]byte, verificationLen)) {
+		err = ErrInvalidVC
+		return
+	}
+	provide := binary.BigEndian.Uint32(fields[verificationLen:])
+	padLength := int(binary.BigEndian.Uint16(fields[verificationLen+4:]))
+	if padLength > maxPadLength {
+		err = ErrInvalidPadLength
+		return
+	}
+
+	// PadC is followed by len(IA)
+	padC := make([]byte, padLength+2)
+	if _, err = io.ReadFull(reader, padC); err != nil {
+		return
+	}
+	decrypter.XORKeyStream(padC, padC)
+	initialPayload := make([]byte, binary.BigEndian.Uint16(padC[padLength:]))
+	if _, err = io.ReadFull(reader, initialPayload); err != nil {
+		return
+	}
+	decrypter.XORKeyStream(initialPayload, initialPayload)
+
+	var selected uint32
+	switch {
+	case provide&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&CryptoPlaintext != 0 && policy == Preferred:
+		selected = CryptoPlaintext
+	default:
+		err = ErrNoCommonCrypto
+		return
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	var buffer bytes.Buffer
+	buffer.Write(make([]byte, verificationLen))
+	binary.Write(&buffer, binary.BigEndian, selected)
+	binary.Write(&buffer, binary.BigEndian, uint16(0))
+	response := buffer.Bytes()
+	encrypter.XORKeyStream(response, response)
+	if _, err = conn.Write(response); err != nil {
+		return
+	}
+
+	// The initial payload has been decrypted already
+	c.reader = io.MultiReader(bytes.NewReader(initialPayload), reader)
+	if selected == CryptoRC4 {
+		c.reader = &decryptingReader{bytes.NewReader(initialPayload), reader, decrypter}
+		c.encrypter = encrypter
+	}
+	return
+}
+
+// decryptingReader returns the initial payload, then decrypts the rest of the stream.
+type decryptingReader struct {
+	initialPayload *bytes.Reader
+	reader         io.Reader
+	decrypter      *rc4.Cipher
+}
+
+func (r *decryptingReader) Read(b []byte) (n int, err error) {
+	if r.initialPayload.Len() > 0 {
+		return r.initialPayload.Read(b)
+	}
+	n, err = r.reader.Read(b)
+	r.decrypter.XORKeyStream(b[:n], b[:n])
+	return
+}
+
+// synchronize discards the bytes preceding pattern, which must be found within limit bytes.
+func synchronize(reader *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return ErrSyncNotFound
+}
+
+func newKeyPair() (private *big.Int, public []byte) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	private = new(big.Int).SetBytes(key)
+	public = padKey(new(big.Int).Exp(generator, private, prime))
+	return
+}
+
+func sharedSecret(private *big.Int, remote []byte) []byte {
+	return padKey(new(big.Int).Exp(new(big.Int).SetBytes(remote), private, prime))
+}
+
+// padKey returns the 96 bytes big endian representation of a key.
+func padKey(key *big.Int) []byte {
+	bytes := key.Bytes()
+	padded := make([]byte, keyLength)
+	copy(padded[keyLength-len(bytes):], bytes)
+	return padded
+}
+
+func randomPad() []byte {
+	length := make([]byte, 2)
+	if _, err := rand.Read(length); err != nil {
+		panic(err)
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(length))%(maxPadLength+1))
+	rand.Read(pad)
+	return pad
+}
+
+func newCipher(key []byte) *rc4.Cipher {
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	discard := make([]byte, rc4Discard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func hash(prefix string, values ...interface{}) []byte {
+	h := sha1.New()
+	h.Write([]byte(prefix))
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			h.Write([]byte(v))
+		case []byte:
+			h.Write(v)
+		}
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+const infoHash = "abcdefghij0123456789"
+
+// handshake connects two peers over loopback and runs the handshake on both sides.
+func handshake(t *testing.T, initiator, receiver Policy) (outgoing, incoming *Conn, outErr, inErr error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		incoming, err = Accept(conn, []string{"0123456789abcdefghij", infoHash}, receiver)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing, outErr = Initiate(conn, infoHash, initiator)
+	if outErr != nil {
+		conn.Close()
+	} else {
+		// The receiver needs the first bytes of a plaintext handshake to detect it
+		go outgoing.Write([]byte(protocolHeader))
+	}
+	inErr = <-accepted
+	return
+}
+
+func exchange(t *testing.T, outgoing, incoming *Conn) {
+	defer outgoing.Close()
+	defer incoming.Close()
+
+	for i, message := range []string{protocolHeader, "hello", "and goodbye"} {
+		if i > 0 {
+			go outgoing.Write([]byte(message))
+		}
+
+		value := make([]byte, len(message))
+		if _, err := io.ReadFull(incoming, value); err != nil {
+			t.Fatalf("incoming.Read() returned %v", err)
+		}
+		if string(value) != message {
+			t.Errorf("incoming.Read() == %q, want %q", value, message)
+		}
+	}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	policies := [][2]Policy{{Preferred, Preferred}, {Required, Preferred}, {Preferred, Required}, {Required, Required}}
+	for _, p := range policies {
+		outgoing, incoming, outErr, inErr := handshake(t, p[0], p[1])
+		if outErr != nil || inErr != nil {
+			t.Errorf("handshake(%v, %v) returned %v, %v", p[0], p[1], outErr, inErr)
+			continue
+		}
+		if !outgoing.Encrypted() || !incoming.Encrypted() {
+			t.Errorf("handshake(%v, %v) isn't encrypted", p[0], p[1])
+		}
+		exchange(t, outgoing, incoming)
+	}
+}
+
+func TestPlaintextHandshake(t *testing.T) {
+	outgoing, incoming, outErr, inErr := handshake(t, Disabled, Preferred)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("handshake(Disabled, Preferred) returned %v, %v", outErr, inErr)
+	}
+	if outgoing.Encrypted() || incoming.Encrypted() {
+		t.Errorf("handshake(Disabled, Preferred) is encrypted")
+	}
+	exchange(t, outgoing, incoming)
+
+	if _, _, _, inErr := handshake(t, Disabled, Required); inErr != ErrPlaintextRejected {
+		t.Errorf("handshake(Disabled, Required) returned %v, want %v", inErr, ErrPlaintextRejected)
+	}
+}
+
+func TestUnknownInfoHash(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		_, err = Accept(conn, []string{"0123456789abcdefghij"}, Preferred)
+		accepted <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go Initiate(conn, infoHash, Required)
+
+	if err := <-accepted; err != ErrUnknownInfoHash {
+		t.Errorf("Accept() returned %v, want %v", err, ErrUnknownInfoHash)
+	}
+}
@@ -5,21 +5,88 @@ import (
 	"github.com/moretti/gotorrent/bitarray"
 	"github.com/moretti/gotorrent/messages"
 	"net"
+	"time"
 )
 
 const (
-	PeerMaxRequests = 16
+	// PeerMinRequests and PeerMaxRequests bound the number of outstanding
+	// block requests per peer, the actual depth depends on the peer rate.
+	PeerMinRequests = 4
+	PeerMaxRequests = 250
+
+	// PeerRequestTimeout is the minimum time without receiving any of the
+	// requested blocks before the requests are considered stalled.
+	PeerRequestTimeout = 20 * time.Second
+	PeerDefaultRTT     = time.Second
+
+	// PeerSnubTimeout is the time an unchoked peer has to send us a block
+	PeerSnubTimeout = 60 * time.Second
+
+	// PeerMaxQueuedRequests is the number of blocks a peer can ask us for
+	// before its requests are dropped.
+	PeerMaxQueuedRequests = 250
 )
 
 type Peer struct {
 	connection *PeerConnection
 	torrent    *Torrent
 
+	// Id and Reserved are known once the remote handshake has been received
+	Id       ClientId
+	Reserved [8]byte
+	// ExtendedHandshake is set once the peer has sent it, see BEP 10
+	ExtendedHandshake *ExtendedHandshake
+	// Incoming is true if the peer has connected to us
+	Incoming bool
+	// Encrypted is true if the connection uses Message Stream Encryption
+	Encrypted bool
+	// UTP is true if the connection runs over uTP
+	UTP bool
+	// Source tells where the address of the peer has been found
+	Source PeerSource
+	// halfOpen is true until the handshake of an outgoing connection is received
+	halfOpen bool
+
 	bitField     *bitarray.BitArray
 	amInterested bool
 	IsChoked     bool
+	AmChoking    bool
+	IsInterested bool
+	IsSnubbed    bool
+
+	// lastMessage is when the remote peer sent its last message
+	lastMessage time.Time
+	unchokedAt  time.Time
+
+	DownloadRate *Rate
+	UploadRate   *Rate
 
-	RequestsCount int
+	// Blocks we have requested to the remote peer, oldest first
+	pending     []*PendingBlock
+	rtt         time.Duration
+	lastArrival time.Time
+
+	// Blocks requested by the remote peer, waiting to be uploaded
+	requests []*messages.Request
+
+	// Fast Extension: the pieces we can download while choked,
+	// the ones the peer can download while choked, and the suggested ones
+	allowedFast map[int]bool
+	grantedFast map[int]bool
+	suggested   []int
+
+	// Pieces announced before the metadata of a magnet link is known
+	deferredBitField []byte
+	deferredHaveAll  bool
+	deferredHaves    []int
+}
+
+// PendingBlock is a block request sent to the remote peer and not yet fulfilled.
+type PendingBlock struct {
+	Piece  *Piece
+	Begin  int
+	Length int
+	sent   time.Time
 }
 
 func NewPeer(
@@ -27,15 +94,44 @@ func NewPeer(
 	torrent *Torrent,
 	peerErrors chan<- PeerError,
 	outMessages chan<- PeerMessage,
+	peerHandshakes chan<- PeerHandshake,
 ) *Peer {
 
+	return newPeer(torrent, NewPeerConnection(addr, torrent.InfoHash, peerErrors, outMessages, peerHandshakes))
+}
+
+// NewIncomingPeer creates a peer from a connection accepted by the client.
+func NewIncomingPeer(
+	conn net.Conn,
+	torrent *Torrent,
+	peerErrors chan<- PeerError,
+	outMessages chan<- PeerMessage,
+	peerHandshakes chan<- PeerHandshake,
+) *Peer {
+
+	p := newPeer(torrent, NewIncomingPeerConnection(conn, torrent.InfoHash, peerErrors, outMessages, peerHandshakes))
+	p.Incoming = true
+	return p
+}
+
+func newPeer(torrent *Torrent, connection *PeerConnection) *Peer {
 	p := new(Peer)
 	p.torrent = torrent
-	p.connection = NewPeerConnection(addr, peerErrors, outMessages)
+	p.connection = connection
+	p.connection.encryption = torrent.Encryption
+	p.connection.dialPolicy = torrent.DialPolicy
+	p.connection.utp = torrent.UTP
 
 	p.bitField = bitarray.New(p.torrent.PieceCount)
 	p.IsChoked = true
+	p.AmChoking = true
 	p.amInterested = false
+	p.DownloadRate = NewRate()
+	p.UploadRate = NewRate()
+	p.rtt = PeerDefaultRTT
+	p.lastMessage = time.Now()
+	p.allowedFast = make(map[int]bool)
+	p.grantedFast = make(map[int]bool)
 
 	return p
 }
@@ -44,17 +140,68 @@ func (p *Peer) String() string {
 	return p.connection.addr.String()
 }
 
+// Connect opens the connection and sends our handshake,
+// the pieces we have are announced once the remote peer is identified.
+// The handshake is queued first, ahead of the messages sent while connecting.
 func (p *Peer) Connect() {
-	go func() {
-		p.connection.Connect()
-		p.SendHandshake(p.torrent.InfoHash, string(p.torrent.ClientId))
-		p.SendUnchoke()
-		//p.SendInterested()
-	}()
+	p.SendHandshake(p.torrent.InfoHash, string(p.torrent.ClientId))
+	go p.connection.Connect()
+}
+
+// SetHandshake records the identity of the remote peer.
+func (p *Peer) SetHandshake(hand messages.Handshake) {
+	p.Id = ClientId(hand.PeerId[:])
+	p.Reserved = hand.Reserved
+	// The connection is established once the handshake has been received
+	p.Encrypted = p.connection.IsEncrypted()
+	p.UTP = p.connection.IsUTP()
+}
+
+// SupportsFast returns true if the peer has announced the Fast Extension, we always do.
+func (p *Peer) SupportsFast() bool {
+	return p.Reserved[7]&messages.FastExtensionBit != 0
+}
+
+// SupportsDHT returns true if the peer runs a DHT node, see BEP 5.
+func (p *Peer) SupportsDHT() bool {
+	return p.Reserved[7]&messages.DHTBit != 0
+}
+
+// SupportsExtensions returns true if the peer has announced the Extension Protocol.
+func (p *Peer) SupportsExtensions() bool {
+	return p.Reserved[5]&messages.ExtensionProtocolBit != 0
+}
+
+func (p *Peer) SetExtendedHandshake(handshake *ExtendedHandshake) {
+	p.ExtendedHandshake = handshake
+	if handshake.YourIp != nil {
+		log.Debugf("Peer %v - Our address is %v", p.String(), handshake.YourIp)
+	}
+}
+
+// SupportsExtension returns true if the peer has enabled an extension in its extended handshake.
+func (p *Peer) SupportsExtension(name string) bool {
+	if p.ExtendedHandshake == nil {
+		return false
+	}
+	_, ok := p.ExtendedHandshake.M[name]
+	return ok
+}
+
+func (p *Peer) Close() {
+	p.connection.Close()
+}
+
+func (p *Peer) SendChoke() {
+	log.Debugf("Peer %v - Sending choke", p.String())
+	p.AmChoking = true
+	p.connection.SendMessage(messages.NewChoke())
+	p.RejectRequests()
 }
 
 func (p *Peer) SendUnchoke() {
 	log.Debugf("Peer %v - Sending unchoke", p.String())
+	p.AmChoking = false
 	p.connection.SendMessage(messages.NewUnchoke())
 }
 
@@ -69,17 +216,170 @@ func (p *Peer) SendInterested(interested bool) {
 }
 
 func (p *Peer) SendHandshake(infoHash, peerId string) {
-	p.connection.SendMessage(messages.NewHandshake(infoHash, peerId))
+	hand := messages.NewHandshake(infoHash, peerId)
+	if p.torrent.UsesDHT() {
+		hand.Reserved[7] |= messages.DHTBit
+	}
+	p.connection.SendMessage(hand)
+}
+
+func (p *Peer) SendBitField(bitField []byte) {
+	log.Debugf("Peer %v - Sending bitfield", p.String())
+	p.connection.SendMessage(messages.NewBitArray(bitField))
+}
+
+func (p *Peer) SendHave(pieceIndex int) {
+	p.connection.SendMessage(messages.NewHave(uint32(pieceIndex)))
+}
+
+func (p *Peer) SendHaveAll() {
+	log.Debugf("Peer %v - Sending have all", p.String())
+	p.connection.SendMessage(messages.NewHaveAll())
+}
+
+func (p *Peer) SendHaveNone() {
+	log.Debugf("Peer %v - Sending have none", p.String())
+	p.connection.SendMessage(messages.NewHaveNone())
+}
+
+func (p *Peer) SendAllowedFast(pieceIndex int) {
+	p.connection.SendMessage(messages.NewAllowedFast(uint32(pieceIndex)))
+}
+
+func (p *Peer) SendRejectRequest(request *messages.Request) {
+	p.connection.SendMessage(messages.NewRejectRequest(request.PieceIndex, request.BlockOffset, request.BlockLength))
+}
+
+func (p *Peer) SendExtended(extendedId byte, payload []byte) {
+	p.connection.SendMessage(messages.NewExtended(extendedId, payload))
+}
+
+// SendExtension sends a message to an extension using the id chosen by the peer,
+// it returns false if the peer doesn't support the extension.
+func (p *Peer) SendExtension(name string, payload []byte) bool {
+	if !p.SupportsExtension(name) {
+		return false
+	}
+	p.SendExtended(p.ExtendedHandshake.M[name], payload)
+	return true
+}
+
+func (p *Peer) SendPort(port int) {
+	p.connection.SendMessage(messages.NewPort(uint16(port)))
 }
 
 func (p *Peer) SendRequest(pieceIndex, blockOffset, blockLength int) {
 	p.connection.SendMessage(messages.NewRequest(uint32(pieceIndex), uint32(blockOffset), uint32(blockLength)))
 }
 
-func (p *Peer) SetKeepAlive() {
+func (p *Peer) SendCancel(pieceIndex, blockOffset, blockLength int) {
+	p.connection.SendMessage(messages.NewCancel(uint32(pieceIndex), uint32(blockOffset), uint32(blockLength)))
 }
 
-func (p *Peer) SetHave(message messages.Message) {
+func (p *Peer) SendPiece(pieceIndex, blockOffset int, blockData []byte) {
+	p.connection.SendMessage(messages.NewPiece(uint32(pieceIndex), uint32(blockOffset), blockData))
+}
+
+// QueueRequest stores a block requested by the remote peer,
+// it returns false when the queue is full.
+func (p *Peer) QueueRequest(request *messages.Request) bool {
+	if len(p.requests) >= PeerMaxQueuedRequests {
+		return false
+	}
+
+	p.requests = append(p.requests, request)
+	return true
+}
+
+// CancelRequest removes a block from the upload queue,
+// a fast peer expects a Reject Request in response.
+func (p *Peer) CancelRequest(cancel *messages.Cancel) {
+	for i, request := range p.requests {
+		if request.PieceIndex == cancel.PieceIndex &&
+			request.BlockOffset == cancel.BlockOffset &&
+			request.BlockLength == cancel.BlockLength {
+			p.requests = append(p.requests[:i], p.requests[i+1:]...)
+			if p.SupportsFast() {
+				p.SendRejectRequest(request)
+			}
+			return
+		}
+	}
+}
+
+// RejectRequest refuses a block requested by the remote peer, only fast peers are told.
+func (p *Peer) RejectRequest(request *messages.Request) {
+	if p.SupportsFast() {
+		p.SendRejectRequest(request)
+	}
+}
+
+// RejectRequests empties the upload queue after a choke,
+// only the requests for the allowed fast pieces are kept.
+func (p *Peer) RejectRequests() {
+	var kept []*messages.Request
+	for _, request := range p.requests {
+		if p.IsGrantedFast(int(request.PieceIndex)) {
+			kept = append(kept, request)
+		} else {
+			p.RejectRequest(request)
+		}
+	}
+	p.requests = kept
+}
+
+// PopRequest dequeues the oldest request to serve, it returns nil when the
+// queue is empty or when the blocks already sent haven't been read yet.
+func (p *Peer) PopRequest() (request *messages.Request) {
+	if len(p.requests) == 0 || !p.connection.CanSendPiece() {
+		return nil
+	}
+
+	request = p.requests[0]
+	p.requests = p.requests[1:]
+	return
+}
+
+// Touch records that the remote peer has sent a message, keep-alives included.
+func (p *Peer) Touch(now time.Time) {
+	p.lastMessage = now
+}
+
+// IsIdle returns true if the peer has been silent for longer than timeout.
+func (p *Peer) IsIdle(now time.Time, timeout time.Duration) bool {
+	return now.Sub(p.lastMessage) > timeout
+}
+
+// SetChoked records a choke or unchoke sent by the remote peer.
+func (p *Peer) SetChoked(choked bool) {
+	if p.IsChoked && !choked {
+		p.unchokedAt = time.Now()
+	}
+	p.IsChoked = choked
+}
+
+// CheckSnubbed marks the peer as snubbed if it has unchoked us,
+// but hasn't sent us anything for PeerSnubTimeout.
+func (p *Peer) CheckSnubbed(now time.Time) bool {
+	if p.IsChoked || !p.amInterested {
+		return p.IsSnubbed
+	}
+
+	progress := p.unchokedAt
+	if p.lastArrival.After(progress) {
+		progress = p.lastArrival
+	}
+
+	if !p.IsSnubbed && now.Sub(progress) > PeerSnubTimeout {
+		log.Debugf("Peer %v - Snubbed", p.String())
+		p.IsSnubbed = true
+	}
+	return p.IsSnubbed
+}
+
+// SetHave records a piece announced by the peer, it returns the piece index
+// and false if the message is invalid or the piece was already known.
+func (p *Peer) SetHave(message messages.Message) (index int, ok bool) {
 	haveMsg, err := message.ToHave()
 
 	if err != nil {
@@ -87,51 +387,270 @@ func (p *Peer) SetHave(message messages.Message) {
 		return
 	}
 
-	if int(haveMsg.PieceIndex) >= p.bitField.Len() {
+	index = int(haveMsg.PieceIndex)
+	if !p.torrent.HasMetadata() {
+		p.deferredHaves = append(p.deferredHaves, index)
+		return
+	}
+
+	if index >= p.bitField.Len() {
 		log.Errorf("Peer %v - Have message, invalid piece index: %v, piece count: %v", p.String(), haveMsg.PieceIndex, p.bitField.Len())
 		return
 	}
 
+	if p.bitField.IsSet(index) {
+		return
+	}
+
 	log.Debugf("Peer %v - Have piece #%v", p.String(), haveMsg.PieceIndex)
-	p.bitField.Set(int(haveMsg.PieceIndex))
+	p.bitField.Set(index)
+	ok = true
+	return
 }
 
-func (p *Peer) SetBitField(message messages.Message) {
+// SetBitField replaces the pieces of the peer, it returns false if the message is invalid.
+func (p *Peer) SetBitField(message messages.Message) bool {
 	bitMsg, err := message.ToBitArray()
 
 	if err != nil {
 		log.Errorf("Peer %v - Unable to parse the bitarray message: %v", p.String(), err)
-		return
+		return false
+	}
+
+	if !p.torrent.HasMetadata() {
+		p.deferredBitField = bitMsg.BitField
+		return false
 	}
 
 	pieceCount := p.torrent.PieceCount
 	if bitCount := (bitMsg.Header.Length - 1) * 8; pieceCount > int(bitCount) {
 		log.Errorf("Peer %v - Invalid bitfield, bit count: %v, piece count: %v", p.String(), bitCount, pieceCount)
-		return
+		return false
 	}
 	p.bitField = bitarray.NewFromBytes(bitMsg.BitField, pieceCount)
 	log.Debugf("Peer %v - New BitField:", p.String())
+	return true
+}
+
+// ApplyMetadata sizes the bitfield once the metadata of a magnet link is known,
+// and replays the pieces the peer has announced in the meantime.
+func (p *Peer) ApplyMetadata() {
+	pieceCount := p.torrent.PieceCount
+	p.bitField = bitarray.New(pieceCount)
+
+	if p.deferredHaveAll {
+		p.SetHaveAll(true)
+	} else if p.deferredBitField != nil && len(p.deferredBitField)*8 >= pieceCount {
+		p.bitField = bitarray.NewFromBytes(p.deferredBitField, pieceCount)
+	}
+
+	for _, index := range p.deferredHaves {
+		if index < pieceCount {
+			p.bitField.Set(index)
+		}
+	}
+
+	p.deferredBitField = nil
+	p.deferredHaves = nil
+}
+
+// IsSeed returns true if the peer has every piece.
+func (p *Peer) IsSeed() bool {
+	return p.torrent.HasMetadata() && p.bitField.Cardinality() == p.torrent.PieceCount
 }
 
 func (p *Peer) BitField() *bitarray.BitArray {
 	return p.bitField
 }
 
-func (p *Peer) RequestPiece(piece *Piece) {
-	for {
-		block := piece.NextBlock()
-		if block == nil {
-			break
+// RequestBlock asks the remote peer for a block and tracks it until it arrives.
+func (p *Peer) RequestBlock(piece *Piece, block *BlockRequest) {
+	p.pending = append(p.pending, &PendingBlock{
+		Piece:  piece,
+		Begin:  block.Begin,
+		Length: block.Length,
+		sent:   time.Now(),
+	})
+	p.SendRequest(piece.Index(), block.Begin, block.Length)
+}
+
+// QueueDepth is the number of requests needed to keep the link busy,
+// i.e. the bandwidth-delay product plus some slack.
+func (p *Peer) QueueDepth() int {
+	// A snubbed peer gets a single request at a time
+	if p.IsSnubbed {
+		return 1
+	}
+
+	depth := int(p.DownloadRate.Rate()*p.rtt.Seconds())/MaxBlockLength + PeerMinRequests
+	if depth > PeerMaxRequests {
+		depth = PeerMaxRequests
+	}
+	// The peer may have told us how many requests it can queue
+	if p.ExtendedHandshake != nil && p.ExtendedHandshake.Reqq > 0 && depth > p.ExtendedHandshake.Reqq {
+		depth = p.ExtendedHandshake.Reqq
+	}
+	return depth
+}
+
+// CanRequest returns true if there is room for another block request.
+func (p *Peer) CanRequest() bool {
+	return len(p.pending) < p.QueueDepth()
+}
+
+// CanDownload returns true if the piece can be requested to the peer,
+// while choked only the allowed fast pieces can.
+func (p *Peer) CanDownload(pieceIndex int) bool {
+	return p.bitField.IsSet(pieceIndex) && (!p.IsChoked || p.allowedFast[pieceIndex])
+}
+
+// SetAllowedFast records a piece we can download while choked.
+func (p *Peer) SetAllowedFast(pieceIndex int) {
+	p.allowedFast[pieceIndex] = true
+}
+
+// GrantFast lets the peer download a piece while choked.
+func (p *Peer) GrantFast(pieceIndex int) {
+	p.grantedFast[pieceIndex] = true
+}
+
+func (p *Peer) IsGrantedFast(pieceIndex int) bool {
+	return p.grantedFast[pieceIndex]
+}
+
+// Suggest records a piece suggested by the peer.
+func (p *Peer) Suggest(pieceIndex int) {
+	p.suggested = append(p.suggested, pieceIndex)
+}
+
+// SuggestedPiece returns the position in pieceIndices of a piece suggested by the peer, or -1.
+func (p *Peer) SuggestedPiece(pieceIndices []int) int {
+	for _, suggested := range p.suggested {
+		for i, index := range pieceIndices {
+			if index == suggested {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// SetHaveAll replaces the pieces of the peer after a Have All or Have None message.
+func (p *Peer) SetHaveAll(haveAll bool) {
+	if !p.torrent.HasMetadata() {
+		p.deferredHaveAll = haveAll
+		return
+	}
+
+	p.bitField = bitarray.New(p.torrent.PieceCount)
+	if haveAll {
+		for i := 0; i < p.bitField.Len(); i++ {
+			p.bitField.Set(i)
+		}
+	}
+}
+
+// RejectBlock forgets an outstanding request refused by the peer.
+func (p *Peer) RejectBlock(pieceIndex, begin int) *PendingBlock {
+	for i, block := range p.pending {
+		if block.Piece.Index() == pieceIndex && block.Begin == begin {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			return block
+		}
+	}
+	return nil
+}
+
+// PendingCount is the number of outstanding block requests.
+func (p *Peer) PendingCount() int {
+	return len(p.pending)
+}
+
+// HasRequested returns true if the block is among the outstanding requests.
+func (p *Peer) HasRequested(pieceIndex, begin int) bool {
+	for _, block := range p.pending {
+		if block.Piece.Index() == pieceIndex && block.Begin == begin {
+			return true
+		}
+	}
+	return false
+}
+
+// CancelBlock forgets an outstanding request and sends a Cancel message,
+// it returns false if the block wasn't requested to this peer.
+func (p *Peer) CancelBlock(pieceIndex, begin int) bool {
+	for i, block := range p.pending {
+		if block.Piece.Index() == pieceIndex && block.Begin == begin {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			// The request may not have left yet
+			if !p.connection.CancelRequest(pieceIndex, begin, block.Length) {
+				p.SendCancel(pieceIndex, begin, block.Length)
+			}
+			return true
 		}
+	}
+	return false
+}
+
+// BlockReceived removes a block from the outstanding requests,
+// it returns false if the block was never requested to this peer.
+func (p *Peer) BlockReceived(pieceIndex, begin int) bool {
+	now := time.Now()
+	defer func() {
+		p.lastArrival = now
+	}()
+	p.IsSnubbed = false
+
+	for i, block := range p.pending {
+		if block.Piece.Index() == pieceIndex && block.Begin == begin {
+			// The request was sent while the peer was idle,
+			// otherwise the latency would include the time spent in the queue
+			if block.sent.After(p.lastArrival) {
+				p.rtt = (7*p.rtt + now.Sub(block.sent)) / 8
+			}
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
 
-		p.SendRequest(piece.Index(), block.Begin, block.Length)
+// ReleaseBlocks returns, and forgets, every outstanding request.
+func (p *Peer) ReleaseBlocks() (blocks []*PendingBlock) {
+	blocks = p.pending
+	p.pending = nil
+	return
+}
+
+// StalledBlocks returns, and forgets, the outstanding requests
+// if the peer hasn't sent any of them in time.
+func (p *Peer) StalledBlocks(now time.Time) (blocks []*PendingBlock) {
+	if len(p.pending) == 0 {
+		return
+	}
+
+	timeout := 4 * p.rtt
+	if timeout < PeerRequestTimeout {
+		timeout = PeerRequestTimeout
 	}
+
+	progress := p.pending[0].sent
+	if p.lastArrival.After(progress) {
+		progress = p.lastArrival
+	}
+
+	if now.Sub(progress) > timeout {
+		blocks = p.pending
+		p.pending = nil
+	}
+	return
 }
 
 func (p *Peer) AmInterested(activePieces, completedPieces *bitarray.BitArray) (interested bool, pieces []int) {
 	// pieces = peerHas ^ (peerHas & (active | completed))
 	pieces = p.BitField().Xor(p.bitField.And(activePieces.Or(completedPieces))).SetIndices()
-	interested = len(pieces) > 0
+	// The peer may also have blocks of the pieces being downloaded
+	interested = p.BitField().And(completedPieces).Cardinality() < p.BitField().Cardinality()
 
 	if interested != p.amInterested {
 		p.amInterested = interested
@@ -0,0 +1,148 @@
+package gotorrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueDepth(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+
+	tests := []struct {
+		rate     int
+		rtt      time.Duration
+		reqq     int
+		expected int
+	}{
+		{0, PeerDefaultRTT, 0, PeerMinRequests},
+		{10 * MaxBlockLength, time.Second, 0, 10 + PeerMinRequests},
+		{10 * MaxBlockLength, 500 * time.Millisecond, 0, 5 + PeerMinRequests},
+		{64 * MaxBlockLength, 2 * time.Second, 0, 128 + PeerMinRequests},
+		{640 * MaxBlockLength, time.Second, 0, PeerMaxRequests},
+		// The peer can only queue so many requests
+		{640 * MaxBlockLength, time.Second, 50, 50},
+	}
+
+	for _, test := range tests {
+		peer := newTestPeer(torrent.PeerManager, "10.0.0.1:6881")
+		peer.DownloadRate.Add(test.rate * RateWindow)
+		peer.rtt = test.rtt
+		if test.reqq > 0 {
+			peer.SetExtendedHandshake(&ExtendedHandshake{Reqq: test.reqq})
+		}
+
+		if value := peer.QueueDepth(); value != test.expected {
+			t.Errorf("QueueDepth() == %v at %v B/s with a %v RTT, want %v", value, test.rate, test.rtt, test.expected)
+		}
+	}
+}
+
+func TestStalledBlocks(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 2*MaxBlockLength), 2*MaxBlockLength)
+	piece := torrent.Pieces[0]
+
+	tests := []struct {
+		rtt time.Duration
+		// arrival is the time of the last block received after the requests, if any
+		arrival  time.Duration
+		elapsed  time.Duration
+		expected int
+	}{
+		{PeerDefaultRTT, 0, PeerRequestTimeout - time.Second, 0},
+		{PeerDefaultRTT, 0, PeerRequestTimeout + time.Second, 2},
+		// A slow link gets 4 round trips
+		{10 * time.Second, 0, 30 * time.Second, 0},
+		{10 * time.Second, 0, 41 * time.Second, 2},
+		// Any progress restarts the timeout
+		{PeerDefaultRTT, 15 * time.Second, PeerRequestTimeout + time.Second, 0},
+	}
+
+	for _, test := range tests {
+		peer := newTestPeer(torrent.PeerManager, "10.0.0.1:6881")
+		peer.rtt = test.rtt
+		peer.RequestBlock(piece, piece.NextBlock(peer))
+		peer.RequestBlock(piece, piece.NextBlock(peer))
+		piece.Reset()
+
+		sent := peer.pending[0].sent
+		if test.arrival > 0 {
+			peer.lastArrival = sent.Add(test.arrival)
+		}
+
+		blocks := peer.StalledBlocks(sent.Add(test.elapsed))
+		if len(blocks) != test.expected || peer.PendingCount() != 2-test.expected {
+			t.Errorf("StalledBlocks() == %v blocks, %v pending after %v with a %v RTT, want %v blocks",
+				len(blocks), peer.PendingCount(), test.elapsed, test.rtt, test.expected)
+		}
+	}
+}
+
+func TestSnubbed(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+	peer := newTestPeer(torrent.PeerManager, "10.0.0.1:6881")
+	peer.SetHaveAll(true)
+	peer.AmInterested(torrent.ActivePieces, torrent.CompletedPieces)
+
+	// A peer which hasn't unchoked us can't snub us
+	if peer.CheckSnubbed(time.Now().Add(2 * PeerSnubTimeout)) {
+		t.Errorf("CheckSnubbed() == true while choked")
+	}
+
+	peer.SetChoked(false)
+	unchokedAt := peer.unchokedAt
+	if peer.CheckSnubbed(unchokedAt.Add(PeerSnubTimeout - time.Second)) {
+		t.Errorf("CheckSnubbed() == true before PeerSnubTimeout")
+	}
+	if !peer.CheckSnubbed(unchokedAt.Add(PeerSnubTimeout + time.Second)) {
+		t.Fatalf("CheckSnubbed() == false after PeerSnubTimeout without blocks")
+	}
+	if value := peer.QueueDepth(); value != 1 {
+		t.Errorf("QueueDepth() == %v while snubbed, want 1", value)
+	}
+
+	// Any block makes up for it
+	peer.BlockReceived(0, 0)
+	if peer.IsSnubbed || peer.CheckSnubbed(time.Now()) {
+		t.Errorf("IsSnubbed == true after a block has been received")
+	}
+	if value := peer.QueueDepth(); value != PeerMinRequests {
+		t.Errorf("QueueDepth() == %v, want %v", value, PeerMinRequests)
+	}
+}
+
+func TestSnubbedPieces(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 4*MaxBlockLength), 2*MaxBlockLength)
+	pm := torrent.PeerManager
+	peer := newTestPeer(pm, "10.0.0.1:6881")
+	peer.SetHaveAll(true)
+	pm.picker.AddBitField(peer.BitField())
+	peer.SetChoked(false)
+	peer.IsSnubbed = true
+
+	// No new piece is started with a snubbed peer
+	pm.requestBlocks(peer)
+	if value := peer.PendingCount(); value != 0 || torrent.ActivePieces.Cardinality() != 0 {
+		t.Errorf("%v blocks requested, %v pieces started, want none", value, torrent.ActivePieces.Cardinality())
+	}
+
+	// It still gets the blocks of the pieces in progress
+	torrent.ActivePieces.Set(1)
+	pm.requestBlocks(peer)
+	if peer.PendingCount() != 1 || !peer.HasRequested(1, 0) {
+		t.Errorf("%v blocks requested, want the first block of piece #1", peer.PendingCount())
+	}
+}
+
+func TestIsIdle(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+	peer := newTestPeer(torrent.PeerManager, "10.0.0.1:6881")
+
+	now := time.Now()
+	peer.Touch(now)
+	if peer.IsIdle(now.Add(DefaultPeerTimeout), DefaultPeerTimeout) {
+		t.Errorf("IsIdle() == true after %v", DefaultPeerTimeout)
+	}
+	if !peer.IsIdle(now.Add(DefaultPeerTimeout+time.Second), DefaultPeerTimeout) {
+		t.Errorf("IsIdle() == false after %v", DefaultPeerTimeout+time.Second)
+	}
+}
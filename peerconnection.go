@@ -1,32 +1,91 @@
 package gotorrent
 
 import (
-	"bytes"
 	log "code.google.com/p/tcgl/applog"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/moretti/gotorrent/messages"
+	"github.com/moretti/gotorrent/mse"
+	"github.com/moretti/gotorrent/utp"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-type PeerConnection struct {
-	addr net.TCPAddr
-	conn net.Conn
-	data []byte
+const (
+	// KeepAliveInterval is the time without outgoing traffic after which a keep-alive is sent
+	KeepAliveInterval = 2 * time.Minute
+	// DialTimeout bounds the TCP connection attempts
+	DialTimeout = 5 * time.Second
+	// UTPDialTimeout is shorter, the peers not answering over uTP are retried over TCP
+	UTPDialTimeout = 3 * time.Second
+)
+
+// DialPolicy tells which transports are tried for the outgoing connections.
+type DialPolicy int
+
+const (
+	DialTCP DialPolicy = iota
+	// DialUTPThenTCP falls back to TCP when the peer doesn't answer over uTP
+	DialUTPThenTCP
+)
+
+func (p DialPolicy) String() string {
+	switch p {
+	case DialTCP:
+		return "TCP"
+	case DialUTPThenTCP:
+		return "uTP then TCP"
+	}
+	return fmt.Sprintf("DialPolicy(%d)", int(p))
+}
 
-	outErrors   chan<- PeerError
-	inMessages  chan interface{}
-	outMessages chan<- PeerMessage
+var (
+	ErrInvalidProtocol = errors.New("Invalid protocol string")
+	ErrInvalidInfoHash = errors.New("Invalid info hash")
+)
 
+type PeerConnection struct {
+	addr     net.TCPAddr
+	conn     net.Conn
+	infoHash string
+	// encryption is the policy of the outgoing connections
+	encryption mse.Policy
+	// dialPolicy chooses the transport of the outgoing connections,
+	// uTP connections are dialed from the utp socket of their address family
+	dialPolicy DialPolicy
+	utp        []*utp.Socket
+
+	outErrors     chan<- PeerError
+	outMessages   chan<- PeerMessage
+	outHandshakes chan<- PeerHandshake
+
+	// queue holds the outgoing messages until the writer sends them
+	queue     *sendQueue
 	handshake bool
+	// lock orders the end of the dial with Close, done is closed by Close
+	lock      sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	// dialed is closed once the connection attempt is over, whatever its outcome
+	dialed chan struct{}
+	// errorOnce reports a single failure, the reader and the writer both stop on it
+	errorOnce sync.Once
+}
+
+// IncomingPeer is a connection accepted by the client whose handshake has
+// already been read.
+type IncomingPeer struct {
+	Conn      net.Conn
+	Handshake messages.Handshake
 }
 
 type PeerError struct {
 	Addr net.TCPAddr
 	Err  error
+	// connection tells the failed connection apart from a newer one to the same address
+	connection *PeerConnection
 }
 
 type PeerMessage struct {
@@ -34,44 +93,215 @@ type PeerMessage struct {
 	Message messages.Message
 }
 
+type PeerHandshake struct {
+	Addr      net.TCPAddr
+	Handshake messages.Handshake
+}
+
 func NewPeerConnection(
 	addr net.TCPAddr,
+	infoHash string,
 	outErrors chan<- PeerError,
 	outMessages chan<- PeerMessage,
+	outHandshakes chan<- PeerHandshake,
 ) *PeerConnection {
 
 	pc := new(PeerConnection)
 	pc.addr = addr
+	pc.infoHash = infoHash
 	pc.outErrors = outErrors
 	pc.outMessages = outMessages
-	pc.inMessages = make(chan interface{})
+	pc.outHandshakes = outHandshakes
+	pc.queue = newSendQueue()
+	pc.done = make(chan struct{})
+	pc.dialed = make(chan struct{})
+
+	return pc
+}
+
+// NewIncomingPeerConnection wraps a connection accepted by the client,
+// the remote handshake has already been consumed.
+func NewIncomingPeerConnection(
+	conn net.Conn,
+	infoHash string,
+	outErrors chan<- PeerError,
+	outMessages chan<- PeerMessage,
+	outHandshakes chan<- PeerHandshake,
+) *PeerConnection {
+
+	addr := tcpAddr(conn.RemoteAddr())
+	pc := NewPeerConnection(addr, infoHash, outErrors, outMessages, outHandshakes)
+	pc.conn = conn
+	pc.handshake = true
+	close(pc.dialed)
 
 	return pc
 }
 
 func (pc *PeerConnection) Connect() {
 	addr := pc.addr.String()
+	if pc.conn != nil {
+		log.Debugf("Accepted connection from %s", addr)
+		go pc.reader()
+		go pc.writer()
+		return
+	}
+
 	log.Debugf("Connecting to %s...", addr)
-	var err error
-	pc.conn, err = net.DialTimeout("tcp", addr, time.Second*5)
+	conn, err := pc.dial()
 	if err != nil {
+		close(pc.dialed)
 		log.Debugf("Unable to connect to %s", addr)
 		pc.outError(err)
-	} else {
-		log.Debugf("Connected to %s", addr)
-		go pc.reader()
-		go pc.writer()
+		return
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	defer close(pc.dialed)
+
+	// The peer may have been dropped during the dial
+	select {
+	case <-pc.done:
+		log.Debugf("Connected to %s after the connection was closed", addr)
+		conn.Close()
+		return
+	default:
+	}
+
+	log.Debugf("Connected to %s", addr)
+	pc.conn = conn
+	go pc.reader()
+	go pc.writer()
+}
+
+// Dialed returns a channel closed once Connect is done dialing,
+// a connection closed by then doesn't use any resource anymore.
+func (pc *PeerConnection) Dialed() <-chan struct{} {
+	return pc.dialed
+}
+
+// dial connects to the peer and negotiates the encryption,
+// it reconnects in plaintext if the peer doesn't support it and we only prefer it.
+func (pc *PeerConnection) dial() (net.Conn, error) {
+	addr := pc.addr.String()
+	conn, err := pc.dialTransport()
+	if err != nil || pc.encryption == mse.Disabled {
+		return conn, err
+	}
+
+	encrypted, err := mse.Initiate(conn, pc.infoHash, pc.encryption)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+
+	if pc.encryption == mse.Required {
+		return nil, err
+	}
+	log.Debugf("Unable to encrypt the connection to %s, retrying in plaintext: %v", addr, err)
+	return pc.dialTransport()
+}
+
+// dialTransport opens the connection following the dial policy.
+func (pc *PeerConnection) dialTransport() (net.Conn, error) {
+	addr := pc.addr.String()
+	if socket := pc.utpSocket(); pc.dialPolicy == DialUTPThenTCP && socket != nil {
+		conn, err := socket.DialTimeout(addr, UTPDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Unable to connect to %s over uTP, trying TCP: %v", addr, err)
+	}
+	return net.DialTimeout("tcp", addr, DialTimeout)
+}
+
+// utpSocket returns the uTP socket of the address family of the peer.
+func (pc *PeerConnection) utpSocket() *utp.Socket {
+	for _, socket := range pc.utp {
+		local, ok := socket.Addr().(*net.UDPAddr)
+		if ok && (local.IP.To4() == nil) == (pc.addr.IP.To4() == nil) {
+			return socket
+		}
+	}
+	return nil
+}
+
+// IsUTP returns true if the connection runs over uTP.
+func (pc *PeerConnection) IsUTP() bool {
+	conn := pc.conn
+	if encrypted, ok := conn.(*mse.Conn); ok {
+		conn = encrypted.Conn
+	}
+	_, ok := conn.(*utp.Conn)
+	return ok
+}
+
+// tcpAddr converts the address of a TCP or uTP connection,
+// the peers are identified by IP and port whatever the transport.
+func tcpAddr(addr net.Addr) net.TCPAddr {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return *addr
+	case *net.UDPAddr:
+		return net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
 	}
+	return net.TCPAddr{}
+}
+
+// IsEncrypted returns true if the connection is obfuscated with MSE.
+func (pc *PeerConnection) IsEncrypted() bool {
+	conn, ok := pc.conn.(*mse.Conn)
+	return ok && conn.Encrypted()
 }
 
+// SendMessage queues a message, the messages are written in order once
+// connected, except the pieces which wait for the other messages.
 func (pc *PeerConnection) SendMessage(message interface{}) {
-	go func() {
-		pc.inMessages <- message
-	}()
+	if err := pc.queue.Push(message); err != nil {
+		log.Errorf("Peer %v - Unable to queue message: %v", pc.addr, err)
+	}
+}
+
+// CancelRequest removes a Request which hasn't been sent yet,
+// it returns false if it's too late.
+func (pc *PeerConnection) CancelRequest(pieceIndex, blockOffset, blockLength int) bool {
+	return pc.queue.CancelRequest(uint32(pieceIndex), uint32(blockOffset), uint32(blockLength))
+}
+
+// CanSendPiece returns true if the queued pieces leave room for another block,
+// the uploads are paced by how fast the peer reads them.
+func (pc *PeerConnection) CanSendPiece() bool {
+	return pc.queue.PieceBytes() < MaxQueuedPieceBytes
+}
+
+// Close drops the connection, the reader and the writer will terminate.
+func (pc *PeerConnection) Close() {
+	pc.closeOnce.Do(func() {
+		pc.lock.Lock()
+		defer pc.lock.Unlock()
+
+		close(pc.done)
+		if pc.conn != nil {
+			pc.conn.Close()
+		}
+	})
 }
 
+// outError reports the first failure of the connection, unless we have closed it.
 func (pc *PeerConnection) outError(err error) {
-	pc.outErrors <- PeerError{Addr: pc.addr, Err: err}
+	pc.errorOnce.Do(func() {
+		select {
+		case <-pc.done:
+			return
+		default:
+		}
+
+		select {
+		case pc.outErrors <- PeerError{Addr: pc.addr, Err: err, connection: pc}:
+		case <-pc.done:
+		}
+	})
 }
 
 func (pc *PeerConnection) outMessage(message messages.Message) {
@@ -83,119 +313,112 @@ func (pc *PeerConnection) reader() {
 	defer func() {
 		log.Debugf("Peer %v - Finished reading, err: %v", pc.addr, err)
 		pc.conn.Close()
+		pc.outError(err)
 	}()
 
-	if err = pc.readHandshake(); err != nil {
-		return
+	if !pc.handshake {
+		if err = pc.readHandshake(); err != nil {
+			return
+		}
+		pc.handshake = true
+	}
+
+	reader := newMessageReader(pc.conn)
+	for {
+		var message messages.Message
+		if message, err = reader.ReadMessage(); err != nil {
+			return
+		}
+		pc.outMessage(message)
 	}
+}
+
+func (pc *PeerConnection) writer() {
+	var err error
+	defer func() {
+		log.Debugf("Peer %v - Finished writing, err: %v", pc.addr, err)
+		pc.conn.Close()
+		pc.outError(err)
+	}()
 
-	bytesCount := 0
-	buf := make([]byte, MaxBlockLength*2)
+	keepAlive := time.NewTimer(KeepAliveInterval)
+	defer keepAlive.Stop()
 
 	for {
-		pc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		n, err := pc.conn.Read(buf)
+		var data []byte
+		if data, err = pc.queue.Next(); err != nil {
+			return
+		}
 
-		if err != nil && err != io.EOF {
-			if netErr, ok := err.(net.Error); ok && !netErr.Timeout() {
-				log.Errorf("Peer %v - Err: %v", pc.addr, err)
+		if data == nil {
+			select {
+			case <-pc.queue.ready:
+			case <-keepAlive.C:
+				log.Debugf("Peer %v - Sending keep alive", pc.addr)
+				pc.SendMessage(messages.NewKeepAlive())
+			case <-pc.done:
 				return
 			}
+			continue
 		}
 
-		if n > len(buf) {
-			err = fmt.Errorf("Whoops, I readed too many bytes %v, my buffer is not big enough", pc.addr, n)
+		if _, err = pc.conn.Write(data); err != nil {
 			return
 		}
-
-		readed := buf[:n]
-		//log.Debugf("Peer %v - Readed %v bytes", pc.addr, n)
-
-		bytesCount += n
-		pc.data = append(pc.data, readed...)
-
-		if len(pc.data) > 4 {
-			message, n, err := parseData(pc.data)
-			if err != nil {
-				return
-			}
-			if n > 0 {
-				if n > len(pc.data) {
-					log.Errorf("Peer %v - Something went wrong, n > len(data)", pc.addr, n, pc.data)
-				}
-				pc.data = pc.data[n:]
-				//log.Debugf("Peer: %v - Sending message %v", pc.addr, message.Header)
-				pc.outMessage(message)
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
 			}
 		}
+		keepAlive.Reset(KeepAliveInterval)
 	}
 }
 
-func parseData(data []byte) (message messages.Message, n int, err error) {
-	n = 0
-	var length uint32
-
-	err = binary.Read(bytes.NewBuffer(data[:4]), binary.BigEndian, &length)
+func (pc *PeerConnection) readHandshake() (err error) {
+	hand, err := readHandshake(pc.conn)
 	if err != nil {
-		log.Errorf("Cannot read the message length: %v", err)
 		return
 	}
 
-	if length > MaxBlockLength {
-		err = fmt.Errorf("Whoops, something went wrong, message length is too long: %v", length)
-		return
-	}
+	log.Debugf("Peer %v - Handshake: %v", pc.addr.String(), hand.String())
 
-	if int(length) > len(data) {
-		//log.Debugf("Peer: %v - I need more data, message length: %v, data length %v", pc.addr, length, len(data))
+	if err = checkHandshake(hand, pc.infoHash); err != nil {
+		log.Debugf("Peer %v - Invalid handshake: %v", pc.addr.String(), err)
 		return
 	}
 
-	message = messages.Message{}
-	message.Header.Length = length
-
-	data = data[4:]
-	n += 4
-
-	if message.Header.Length > 0 {
-		message.Header.Id = data[0]
-		message.Payload = make([]byte, message.Header.Length-1)
-		copy(message.Payload, data[1:message.Header.Length])
-		n += int(message.Header.Length)
-	}
+	pc.outHandshakes <- PeerHandshake{Addr: pc.addr, Handshake: *hand}
 	return
 }
 
-func (pc *PeerConnection) writer() {
-	for message := range pc.inMessages {
-		err := binary.Write(pc.conn, binary.BigEndian, message)
-		if err != nil {
-			pc.outError(err)
-		}
-	}
-	log.Debugf("Finished writing from peer %v", pc.addr)
-	pc.conn.Close()
-}
-
-func (pc *PeerConnection) readHandshake() (err error) {
+func readHandshake(conn net.Conn) (hand *messages.Handshake, err error) {
 	buf := make([]byte, messages.HandshakeLength)
-	n, err := pc.conn.Read(buf)
 
-	if err != nil {
-		return
-	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
 
-	if n != messages.HandshakeLength {
+	if _, err = io.ReadFull(conn, buf); err != nil {
 		err = errors.New("Cannot read the handshake")
 		return
 	}
 
-	var hand messages.Handshake
-	err = binary.Read(bytes.NewBuffer(buf), binary.BigEndian, &hand)
-	if err != nil {
-		return
+	hand = new(messages.Handshake)
+	err = hand.UnmarshalBinary(buf)
+	return
+}
+
+// checkHandshake verifies that the remote peer speaks the BitTorrent
+// protocol and that it belongs to the swarm identified by infoHash.
+func checkHandshake(hand *messages.Handshake, infoHash string) error {
+	if int(hand.Pstrlen) != len(messages.BitTorrentProtocol) ||
+		string(hand.Pstr[:]) != messages.BitTorrentProtocol {
+		return ErrInvalidProtocol
 	}
 
-	log.Debugf("Peer %v - Handshake: %v", pc.addr.String(), hand.String())
-	return
+	if string(hand.InfoHash[:]) != infoHash {
+		return ErrInvalidInfoHash
+	}
+
+	return nil
 }
@@ -0,0 +1,44 @@
+package gotorrent
+
+import (
+	"github.com/moretti/gotorrent/mse"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseWhileDialing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	peerErrors := make(chan PeerError, 1)
+	pc := NewPeerConnection(*listener.Addr().(*net.TCPAddr), "", peerErrors, nil, nil)
+	pc.encryption = mse.Disabled
+
+	// The peer is dropped before the dial completes
+	pc.Close()
+	pc.Connect()
+	if pc.conn != nil {
+		t.Errorf("Connection kept after Close()")
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() returned %v, want %v", err, io.EOF)
+	}
+	select {
+	case peerError := <-peerErrors:
+		t.Errorf("Failure reported after Close(): %v", peerError.Err)
+	default:
+	}
+}
@@ -3,51 +3,108 @@ package gotorrent
 import (
 	log "code.google.com/p/tcgl/applog"
 	"github.com/moretti/gotorrent/messages"
-	"math/rand"
 	"net"
+	"time"
+)
+
+const (
+	// UploadInterval is how often the queued block requests are served
+	UploadInterval = 100 * time.Millisecond
+	// RequestTimeoutInterval is how often the outstanding requests are checked for timeouts
+	RequestTimeoutInterval = time.Second
+	// DefaultPeerTimeout is longer than the keep-alive interval, a healthy peer is never idle for that long
+	DefaultPeerTimeout = 3 * time.Minute
+	// DHTAnnounceInterval is how often the torrent is announced to the DHT again,
+	// the nodes forget the peers and the tokens expire after a while
+	DHTAnnounceInterval = 20 * time.Minute
 )
 
 type PeerManager struct {
 	Torrent *Torrent
 	Peers   map[string]*Peer
 
-	AddPeerAddr         chan net.TCPAddr
+	AddPeerAddr         chan PeerAddr
+	AddPeerConn         chan IncomingPeer
 	PeerReadyToDownload chan Peer
 
-	Errors     chan PeerError
-	InMessages chan PeerMessage
+	Errors       chan PeerError
+	InMessages   chan PeerMessage
+	InHandshakes chan PeerHandshake
 
 	Quit <-chan bool
+
+	choker     *Choker
+	picker     *PiecePicker
+	endgame    bool
+	extensions []Extension
+	// candidates are the known addresses, connected or not
+	candidates map[string]*candidate
 }
 
 func NewPeerManager(torrent *Torrent) *PeerManager {
 	pm := new(PeerManager)
 	pm.Torrent = torrent
 	pm.Peers = make(map[string]*Peer)
+	pm.candidates = make(map[string]*candidate)
 
-	pm.AddPeerAddr = make(chan net.TCPAddr)
+	pm.AddPeerAddr = make(chan PeerAddr)
+	pm.AddPeerConn = make(chan IncomingPeer)
 	pm.PeerReadyToDownload = make(chan Peer)
 
 	pm.Errors = make(chan PeerError)
 	pm.InMessages = make(chan PeerMessage)
+	pm.InHandshakes = make(chan PeerHandshake)
 
 	pm.Quit = make(<-chan bool)
-
-	go pm.manage()
+	pm.choker = NewChoker()
+	pm.picker = NewPiecePicker(torrent.PieceCount, torrent.FileEnds())
+	for _, factory := range extensionFactories {
+		pm.extensions = append(pm.extensions, factory(pm))
+	}
 
 	return pm
 }
 
+// Start runs the peer manager, the settings of the torrent must not
+// change afterwards.
+func (pm *PeerManager) Start() {
+	go pm.manage()
+}
+
 func (pm *PeerManager) manage() {
+	uploadTicker := time.NewTicker(UploadInterval)
+	defer uploadTicker.Stop()
+	chokeTicker := time.NewTicker(ChokeInterval)
+	defer chokeTicker.Stop()
+	timeoutTicker := time.NewTicker(RequestTimeoutInterval)
+	defer timeoutTicker.Stop()
+	announceTicker := time.NewTicker(DHTAnnounceInterval)
+	defer announceTicker.Stop()
+
+	// Trackerless torrents rely on the DHT only
+	go pm.Torrent.announceDHT()
+
 	for {
 		select {
 		case peerAddr := <-pm.AddPeerAddr:
-			pm.addPeer(peerAddr)
+			pm.addPeer(peerAddr.Addr, peerAddr.Source)
+		case incoming := <-pm.AddPeerConn:
+			pm.addIncomingPeer(incoming)
+		case peerHandshake := <-pm.InHandshakes:
+			pm.processHandshake(peerHandshake)
 		case peerMessage := <-pm.InMessages:
 			//log.Debugf("Receiving message %v from peer %v", peerMessage.Message.Header, peerMessage.Addr)
 			pm.processMessage(peerMessage)
 		case peerError := <-pm.Errors:
 			pm.handleError(peerError)
+		case <-uploadTicker.C:
+			pm.serveRequests()
+		case <-chokeTicker.C:
+			pm.choker.Choke(pm.Peers, pm.Torrent.UploadSlots, pm.Torrent.IsSeeding())
+		case now := <-timeoutTicker.C:
+			pm.checkTimeouts(now)
+		case <-announceTicker.C:
+			go pm.Torrent.announceDHT()
 		case <-pm.Quit:
 			log.Debugf("Quitting...")
 			return
@@ -55,26 +112,98 @@ func (pm *PeerManager) manage() {
 	}
 }
 
-func (pm *PeerManager) addPeer(peerAddr net.TCPAddr) {
-	strAddr := peerAddr.String()
-	if _, ok := pm.Peers[strAddr]; !ok {
-		log.Debugf("Found Peer: %v", peerAddr)
+func (pm *PeerManager) addIncomingPeer(incoming IncomingPeer) {
+	strAddr := incoming.Conn.RemoteAddr().String()
+	if _, ok := pm.Peers[strAddr]; ok {
+		log.Debugf("Peer %v - Already connected", strAddr)
+		incoming.Conn.Close()
+		return
+	}
+
+	if len(pm.Peers) >= pm.Torrent.MaxConnections || !pm.Torrent.Limiter.ReserveIncoming() {
+		log.Debugf("Peer %v - Too many connections", strAddr)
+		incoming.Conn.Close()
+		return
+	}
+
+	log.Debugf("Incoming Peer: %v", strAddr)
+
+	peer := NewIncomingPeer(
+		incoming.Conn,
+		pm.Torrent,
+		pm.Errors,
+		pm.InMessages,
+		pm.InHandshakes)
+
+	peer.Source = SourceIncoming
+
+	if !pm.identifyPeer(peer, incoming.Handshake) {
+		peer.Close()
+		pm.Torrent.Limiter.Release()
+		return
+	}
+
+	pm.Peers[strAddr] = peer
+
+	peer.Connect()
+	pm.greetPeer(peer)
+}
+
+func (pm *PeerManager) processHandshake(peerHandshake PeerHandshake) {
+	strAddr := peerHandshake.Addr.String()
+	peer, ok := pm.Peers[strAddr]
+	if !ok {
+		log.Errorf("Unable to find peer %v", peerHandshake.Addr)
+		return
+	}
 
-		peer := NewPeer(
-			peerAddr,
-			pm.Torrent,
-			pm.Errors,
-			pm.InMessages)
+	if !pm.identifyPeer(peer, peerHandshake.Handshake) {
+		pm.dropPeer(peer)
+		return
+	}
 
-		pm.Peers[strAddr] = peer
+	pm.peerConnected(peer)
+	pm.greetPeer(peer)
+}
+
+// greetPeer sends what follows the handshake: our pieces, our extensions and our DHT port.
+func (pm *PeerManager) greetPeer(peer *Peer) {
+	pm.announcePieces(peer)
+	pm.sendExtendedHandshake(peer)
+	if pm.Torrent.UsesDHT() && peer.SupportsDHT() {
+		peer.SendPort(pm.Torrent.DHT.Addr().Port)
+	}
+}
+
+// identifyPeer records the remote peer id, it returns false when the
+// connection is to ourselves or duplicates an existing one.
+func (pm *PeerManager) identifyPeer(peer *Peer, hand messages.Handshake) bool {
+	peerId := ClientId(hand.PeerId[:])
+
+	if peerId == pm.Torrent.ClientId {
+		log.Debugf("Peer %v - Connected to myself", peer.String())
+		return false
+	}
 
-		peer.Connect()
+	for _, other := range pm.Peers {
+		if other != peer && other.Id == peerId {
+			log.Debugf("Peer %v - Already connected as %v", peer.String(), other.String())
+			return false
+		}
 	}
+
+	peer.SetHandshake(hand)
+	return true
 }
 
 func (pm *PeerManager) handleError(peerError PeerError) {
 	log.Errorf("Peer %v: %v", peerError.Addr.String(), peerError.Err)
-	delete(pm.Peers, peerError.Addr.String())
+
+	// The address may have been connected to again since the failure
+	if peer, ok := pm.Peers[peerError.Addr.String()]; ok && peer.connection == peerError.connection {
+		pm.removePeer(peer, false)
+		pm.connectPeers(time.Now())
+	}
 }
 
 func (pm *PeerManager) processMessage(peerMessage PeerMessage) {
@@ -86,55 +215,226 @@ func (pm *PeerManager) processMessage(peerMessage PeerMessage) {
 		return
 	}
 
+	peer.Touch(time.Now())
+
 	if message.Header.Length == 0 {
 		log.Debugf("Peer %v - Keep alive", peer.String())
-		peer.SetKeepAlive()
 	} else {
 		switch message.Header.Id {
 		case messages.ChokeId:
 			log.Debugf("Peer %v - Chocked", peer.String())
-			peer.IsChoked = true
+			peer.SetChoked(true)
+			// Pending requests are discarded by a choke,
+			// unless the peer is going to reject them explicitly
+			if !peer.SupportsFast() {
+				pm.releaseBlocks(peer, peer.ReleaseBlocks())
+			}
 		case messages.UnchokeId:
-			peer.IsChoked = false
+			peer.SetChoked(false)
 			log.Debugf("Peer %v - Unchocked", peer.String())
-			pm.downloadPiece(peer)
+			pm.requestBlocks(peer)
 		case messages.InterestedId:
+			log.Debugf("Peer %v - Interested", peer.String())
+			peer.IsInterested = true
 		case messages.NotInterestedId:
+			log.Debugf("Peer %v - Not interested", peer.String())
+			peer.IsInterested = false
 		case messages.HaveId:
-			peer.SetHave(message)
-			pm.downloadPiece(peer)
+			if index, ok := peer.SetHave(message); ok {
+				pm.picker.AddPiece(index)
+			}
+			pm.requestBlocks(peer)
 		case messages.BitFieldId:
-			peer.SetBitField(message)
-			pm.downloadPiece(peer)
+			oldBitField := peer.BitField()
+			if peer.SetBitField(message) {
+				pm.picker.RemoveBitField(oldBitField)
+				pm.picker.AddBitField(peer.BitField())
+			}
+			pm.requestBlocks(peer)
 		case messages.RequestId:
+			pm.processRequest(message, peer)
 		case messages.PieceId:
-			peer.RequestsCount--
 			pm.processPiece(message, peer)
+			pm.requestBlocks(peer)
 		case messages.CancelId:
+			pm.processCancel(message, peer)
 		case messages.PortId:
+			pm.processPort(message, peer)
+		case messages.ExtendedId:
+			pm.processExtended(message, peer)
 		default:
-			log.Errorf("Peer %v - Unknown id: %v", peer.String(), message.Header.Id)
+			if !pm.processFastMessage(message, peer) {
+				log.Errorf("Peer %v - Unknown id: %v", peer.String(), message.Header.Id)
+			}
 		}
 	}
 }
 
-func (pm *PeerManager) downloadPiece(peer *Peer) {
-	if peer.IsChoked || peer.RequestsCount > PeerMaxRequests {
+// requestBlocks fills the request queue of the peer, blocks of the pieces
+// being downloaded come first, then a new piece is chosen by the picker.
+func (pm *PeerManager) requestBlocks(peer *Peer) {
+	amInterested, pieceIndices := peer.AmInterested(pm.Torrent.ActivePieces, pm.Torrent.CompletedPieces)
+	if !amInterested {
 		return
 	}
 
-	amInterested, pieceIndices := peer.AmInterested(pm.Torrent.ActivePieces, pm.Torrent.CompletedPieces)
-	if !amInterested {
+	if peer.IsChoked {
+		// Only the allowed fast pieces can be requested while choked
+		allowed := pieceIndices[:0]
+		for _, index := range pieceIndices {
+			if peer.CanDownload(index) {
+				allowed = append(allowed, index)
+			}
+		}
+		pieceIndices = allowed
+	}
+
+	for peer.CanRequest() {
+		piece := pm.activePiece(peer)
+		if piece == nil {
+			// A snubbed peer would hold up a new piece, it only gets
+			// the blocks of the pieces already started
+			if len(pieceIndices) == 0 || peer.IsSnubbed {
+				if pm.isEndgame() {
+					pm.requestEndgameBlocks(peer)
+				}
+				return
+			}
+
+			// Pieces suggested by the peer are probably in its cache,
+			// otherwise random until we have a complete piece to share
+			i := peer.SuggestedPiece(pieceIndices)
+			if i == -1 {
+				random := pm.Torrent.CompletedPieces.Cardinality() == 0
+				i = pm.picker.Pick(pieceIndices, pm.Torrent.Strategy, random)
+			}
+			piece = pm.Torrent.Pieces[pieceIndices[i]]
+			pieceIndices = append(pieceIndices[:i], pieceIndices[i+1:]...)
+
+			log.Debugf("Starting piece #%v with peer %v", piece.Index(), peer.String())
+			pm.Torrent.ActivePieces.Set(piece.Index())
+		}
+
+		block := piece.NextBlock(peer)
+		if block == nil {
+			continue
+		}
+		peer.RequestBlock(piece, block)
+	}
+}
+
+// activePiece returns a piece being downloaded which has blocks that
+// nobody has requested yet and that the peer can send.
+func (pm *PeerManager) activePiece(peer *Peer) *Piece {
+	for _, index := range pm.Torrent.ActivePieces.SetIndices() {
+		piece := pm.Torrent.Pieces[index]
+		if peer.CanDownload(index) && piece.HasFreeBlock() {
+			return piece
+		}
+	}
+	return nil
+}
+
+// isEndgame returns true when every missing block has already been requested.
+// All the peers are asked for the outstanding blocks as soon as that happens.
+func (pm *PeerManager) isEndgame() bool {
+	endgame := false
+	for _, index := range pm.Torrent.CompletedPieces.UnsetIndices() {
+		if !pm.Torrent.ActivePieces.IsSet(index) || pm.Torrent.Pieces[index].HasFreeBlock() {
+			endgame = false
+			break
+		}
+		endgame = true
+	}
+
+	if endgame && !pm.endgame {
+		log.Debugf("Entering endgame mode")
+		pm.endgame = true
+		for _, peer := range pm.Peers {
+			pm.requestEndgameBlocks(peer)
+		}
+	}
+	pm.endgame = endgame
+
+	return endgame
+}
+
+// requestEndgameBlocks asks the peer for the blocks already requested to someone else.
+func (pm *PeerManager) requestEndgameBlocks(peer *Peer) {
+	for _, index := range pm.Torrent.ActivePieces.SetIndices() {
+		if !peer.CanDownload(index) {
+			continue
+		}
+
+		piece := pm.Torrent.Pieces[index]
+		for _, block := range piece.OutstandingBlocks() {
+			if !peer.CanRequest() {
+				return
+			}
+			if !peer.HasRequested(index, block.Begin) {
+				peer.RequestBlock(piece, block)
+			}
+		}
+	}
+}
+
+// cancelBlock cancels the duplicate requests of a block sent during the endgame.
+func (pm *PeerManager) cancelBlock(pieceIndex, begin int) {
+	for _, peer := range pm.Peers {
+		if peer.CancelBlock(pieceIndex, begin) {
+			log.Debugf("Peer %v - Cancelled block, piece #%v offset %v", peer.String(), pieceIndex, begin)
+		}
+	}
+}
+
+// checkTimeouts disconnects idle peers, flags snubbing ones,
+// and releases the blocks requested to stalled peers.
+func (pm *PeerManager) checkTimeouts(now time.Time) {
+	for _, peer := range pm.Peers {
+		if peer.IsIdle(now, pm.Torrent.PeerTimeout) {
+			log.Debugf("Peer %v - Idle for too long", peer.String())
+			pm.removePeer(peer, false)
+			continue
+		}
+		if pm.Torrent.IsBlocked(peer.connection.addr.IP) {
+			log.Debugf("Peer %v - Blocked", peer.String())
+			pm.dropPeer(peer)
+			continue
+		}
+
+		peer.CheckSnubbed(now)
+
+		if blocks := peer.StalledBlocks(now); len(blocks) > 0 {
+			log.Debugf("Peer %v - %v requests timed out", peer.String(), len(blocks))
+			pm.releaseBlocks(peer, blocks)
+		}
+	}
+
+	for _, extension := range pm.extensions {
+		if timer, ok := extension.(ExtensionTimer); ok {
+			timer.Tick(now)
+		}
+	}
+
+	pm.connectPeers(now)
+}
+
+// releaseBlocks returns the blocks owned by peer to the pool,
+// and requests them to the other peers.
+func (pm *PeerManager) releaseBlocks(owner *Peer, blocks []*PendingBlock) {
+	if len(blocks) == 0 {
 		return
 	}
 
-	// Choose a random piece that I don't have
-	pieceIndex := randomChoice(pieceIndices)
-	piece := pm.Torrent.Pieces[pieceIndex]
+	for _, block := range blocks {
+		block.Piece.ReleaseBlock(block.Begin, owner)
+	}
 
-	peer.RequestsCount++
-	log.Debugf("Requesting piece #%v to peer %v", pieceIndex, peer.String())
-	peer.RequestPiece(piece)
+	for _, peer := range pm.Peers {
+		if peer != owner {
+			pm.requestBlocks(peer)
+		}
+	}
 }
 
 func (pm *PeerManager) processPiece(message messages.Message, peer *Peer) {
@@ -147,17 +447,145 @@ func (pm *PeerManager) processPiece(message messages.Message, peer *Peer) {
 
 	log.Debugf("Peer %v - Found a new block - PieceIndex: %v BlockOffset: %v", peer.String(), pieceMsg.PieceIndex, pieceMsg.BlockOffset)
 
+	if int(pieceMsg.PieceIndex) >= pm.Torrent.PieceCount {
+		log.Errorf("Peer %v - Piece message, invalid piece index: %v", peer.String(), pieceMsg.PieceIndex)
+		return
+	}
+
+	// A late block, whose request timed out, is still welcome
+	peer.BlockReceived(int(pieceMsg.PieceIndex), int(pieceMsg.BlockOffset))
+	peer.DownloadRate.Add(len(pieceMsg.BlockData))
+
 	piece := pm.Torrent.Pieces[pieceMsg.PieceIndex]
-	piece.SetBlock(int(pieceMsg.BlockOffset), pieceMsg.BlockData)
+	if !piece.SetBlock(int(pieceMsg.BlockOffset), pieceMsg.BlockData) {
+		return
+	}
+	pm.Torrent.Downloaded += len(pieceMsg.BlockData)
+
+	if pm.endgame {
+		pm.cancelBlock(piece.Index(), int(pieceMsg.BlockOffset))
+	}
+
+	if piece.IsComplete() {
+		pm.completePiece(piece)
+	}
+}
+
+// completePiece verifies a piece whose blocks have all been downloaded,
+// a corrupted piece is downloaded again.
+func (pm *PeerManager) completePiece(piece *Piece) {
+	pm.Torrent.ActivePieces.Unset(piece.Index())
+	if !piece.IsValid() {
+		log.Warningf("Piece #%v failed the hash check", piece.Index())
+		piece.Reset()
+		return
+	}
+
+	log.Debugf("Piece #%v completed", piece.Index())
+	pm.Torrent.CompletedPieces.Set(piece.Index())
+	pm.broadcastHave(piece.Index())
+}
+
+// broadcastHave tells every peer about a verified piece,
+// and updates our interest in what they have.
+func (pm *PeerManager) broadcastHave(pieceIndex int) {
+	for _, peer := range pm.Peers {
+		peer.SendHave(pieceIndex)
+		peer.AmInterested(pm.Torrent.ActivePieces, pm.Torrent.CompletedPieces)
+	}
+}
+
+func (pm *PeerManager) processRequest(message messages.Message, peer *Peer) {
+	request, err := message.ToRequest()
+
+	if err != nil {
+		log.Errorf("Peer %v - Unable to parse the request message: %v", peer.String(), err)
+		return
+	}
+
+	index := int(request.PieceIndex)
+	if index >= pm.Torrent.PieceCount {
+		log.Errorf("Peer %v - Request, invalid piece index: %v", peer.String(), index)
+		pm.dropPeer(peer)
+		return
+	}
+
+	begin, length := int(request.BlockOffset), int(request.BlockLength)
+	if length == 0 || length > MaxRequestLength || begin+length > pm.Torrent.Pieces[index].Len() {
+		log.Errorf("Peer %v - Request, invalid block: offset %v, length %v", peer.String(), begin, length)
+		pm.dropPeer(peer)
+		return
+	}
+
+	if peer.AmChoking && !peer.IsGrantedFast(index) {
+		log.Debugf("Peer %v - Rejecting request from a choked peer", peer.String())
+		peer.RejectRequest(request)
+		return
+	}
+
+	if !pm.Torrent.CompletedPieces.IsSet(index) {
+		log.Debugf("Peer %v - Request for piece #%v that I don't have", peer.String(), index)
+		peer.RejectRequest(request)
+		return
+	}
+
+	if !peer.QueueRequest(request) {
+		log.Debugf("Peer %v - Too many queued requests", peer.String())
+		peer.RejectRequest(request)
+	}
+}
+
+func (pm *PeerManager) processCancel(message messages.Message, peer *Peer) {
+	cancel, err := message.ToCancel()
+
+	if err != nil {
+		log.Errorf("Peer %v - Unable to parse the cancel message: %v", peer.String(), err)
+		return
+	}
+
+	peer.CancelRequest(cancel)
+}
+
+// serveRequests uploads the queued blocks, requests from choked
+// peers have been rejected already unless they are allowed fast.
+func (pm *PeerManager) serveRequests() {
+	for _, peer := range pm.Peers {
+		for request := peer.PopRequest(); request != nil; request = peer.PopRequest() {
+			piece := pm.Torrent.Pieces[request.PieceIndex]
+			block, err := piece.Block(int(request.BlockOffset), int(request.BlockLength))
+			if err != nil {
+				log.Errorf("Peer %v - Unable to read block: %v", peer.String(), err)
+				continue
+			}
+
+			peer.SendPiece(piece.Index(), int(request.BlockOffset), block)
+			pm.Torrent.Uploaded += len(block)
+			peer.UploadRate.Add(len(block))
+		}
+	}
+}
+
+// processPort adds the DHT node of the peer to our routing table.
+func (pm *PeerManager) processPort(message messages.Message, peer *Peer) {
+	portMsg, err := message.ToPort()
+	if err != nil {
+		log.Errorf("Peer %v - Unable to parse the port message: %v", peer.String(), err)
+		return
+	}
+
+	log.Debugf("Peer %v - DHT port: %v", peer.String(), portMsg.ListenPort)
+	if pm.Torrent.UsesDHT() && portMsg.ListenPort != 0 {
+		pm.Torrent.DHT.AddNode(&net.UDPAddr{IP: peer.connection.addr.IP, Port: int(portMsg.ListenPort)})
+	}
 }
 
-func randomChoice(slice []int) int {
-	randomIndex := rand.Intn(len(slice))
-	return slice[randomIndex]
+// dropPeer disconnects a misbehaving peer, its address is forgotten.
+func (pm *PeerManager) dropPeer(peer *Peer) {
+	pm.removePeer(peer, true)
 }
 
-func (pm *PeerManager) UpdatePeers(addresses []net.TCPAddr) {
+func (pm *PeerManager) UpdatePeers(addresses []net.TCPAddr, source PeerSource) {
 	for _, peerAddr := range addresses {
-		pm.AddPeerAddr <- peerAddr
+		pm.AddPeerAddr <- PeerAddr{Addr: peerAddr, Source: source}
 	}
 }
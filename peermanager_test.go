@@ -0,0 +1,245 @@
+package gotorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/moretti/gotorrent/messages"
+	"github.com/moretti/gotorrent/metainfo"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testInfo returns the info dictionary of data and its bencoded form.
+func testInfo(data []byte, pieceLength int) (info *metainfo.InfoDict, infoBytes []byte) {
+	info = &metainfo.InfoDict{Name: "test", Length: len(data), PieceLength: pieceLength}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		info.Pieces += string(hash[:])
+	}
+
+	infoBytes, _ = encodeDict(map[string]interface{}{
+		"name":         info.Name,
+		"length":       info.Length,
+		"piece length": info.PieceLength,
+		"pieces":       info.Pieces,
+	})
+	return
+}
+
+// newTestTorrent returns a torrent downloading data, its peer manager isn't started.
+func newTestTorrent(t *testing.T, data []byte, pieceLength int) *Torrent {
+	info, infoBytes := testInfo(data, pieceLength)
+	hash := sha1.Sum(infoBytes)
+
+	torrent, err := NewTorrent(
+		NewClientId(),
+		6881,
+		"magnet:?xt=urn:btih:"+hex.EncodeToString(hash[:]),
+		".",
+		NewConnectionLimiter(DefaultMaxConnections, DefaultMaxHalfOpen))
+	if err != nil {
+		t.Fatalf("NewTorrent() returned %v", err)
+	}
+	if err = torrent.PeerManager.applyMetadata(info, string(infoBytes)); err != nil {
+		t.Fatalf("applyMetadata() returned %v", err)
+	}
+	return torrent
+}
+
+// newTestPeer adds a peer which has sent its handshake, nothing is sent over the network.
+func newTestPeer(pm *PeerManager, addr string) *Peer {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	peer := NewPeer(*tcpAddr, pm.Torrent, pm.Errors, pm.InMessages, pm.InHandshakes)
+	peer.Id = NewClientId()
+	pm.Torrent.Limiter.ReserveIncoming()
+	pm.Peers[peer.String()] = peer
+	return peer
+}
+
+// toMessage converts a message of the messages package for processMessage.
+func toMessage(message interface{}) (m messages.Message) {
+	data, _ := messages.Marshal(message)
+	m.UnmarshalBinary(data)
+	return
+}
+
+// sentMessages returns, and forgets, the messages queued for the peer.
+func sentMessages(t *testing.T, peer *Peer) (sent []interface{}) {
+	var data []byte
+	for {
+		next, err := peer.connection.queue.Next()
+		if err != nil {
+			t.Fatalf("Peer %v - Unable to send: %v", peer.String(), err)
+		}
+		if next == nil {
+			break
+		}
+		data = append(data, next...)
+	}
+
+	reader := newMessageReader(bytes.NewReader(data))
+	for {
+		message, err := reader.ReadMessage()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Peer %v - Unable to read the sent messages: %v", peer.String(), err)
+		}
+		decoded, err := message.Decode()
+		if err != nil {
+			t.Fatalf("Peer %v - Unable to decode %v: %v", peer.String(), message.Header, err)
+		}
+		sent = append(sent, decoded)
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, MaxBlockLength), MaxBlockLength)
+	pm := torrent.PeerManager
+
+	// The reader and the writer both fail, the failure is reported once
+	stale := NewPeerConnection(net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}, torrent.InfoHash, pm.Errors, pm.InMessages, pm.InHandshakes)
+	go stale.outError(io.EOF)
+	go stale.outError(io.ErrUnexpectedEOF)
+	peerError := <-pm.Errors
+	select {
+	case second := <-pm.Errors:
+		t.Fatalf("Failure reported twice: %v, %v", peerError.Err, second.Err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The failure of a previous connection doesn't remove the new one
+	peer := newTestPeer(pm, "10.0.0.1:6881")
+	pm.handleError(peerError)
+	if pm.Peers[peer.String()] != peer {
+		t.Errorf("Peer %v removed by the failure of an older connection", peer.String())
+	}
+
+	go peer.connection.outError(io.EOF)
+	pm.handleError(<-pm.Errors)
+	if _, ok := pm.Peers[peer.String()]; ok {
+		t.Errorf("Peer %v kept after its connection failed", peer.String())
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 4*MaxBlockLength), 2*MaxBlockLength)
+	torrent.CompletedPieces.Set(0)
+	pm := torrent.PeerManager
+
+	peer := newTestPeer(pm, "10.0.0.1:6881")
+	// Fast peers are told about the rejected requests
+	peer.Reserved[7] |= messages.FastExtensionBit
+	request := messages.NewRequest(0, 0, MaxBlockLength)
+
+	expectSent := func(expected ...interface{}) {
+		value := sentMessages(t, peer)
+		if len(value) != len(expected) {
+			t.Fatalf("Sent %v messages, want %v", len(value), len(expected))
+		}
+		for i := range expected {
+			if !reflect.DeepEqual(value[i], expected[i]) {
+				t.Errorf("Sent %#v, want %#v", value[i], expected[i])
+			}
+		}
+	}
+	reject := messages.NewRejectRequest(request.PieceIndex, request.BlockOffset, request.BlockLength)
+
+	// Choked peers are rejected
+	pm.processRequest(toMessage(request), peer)
+	expectSent(reject)
+
+	peer.AmChoking = false
+
+	// We don't have the second piece
+	pm.processRequest(toMessage(messages.NewRequest(1, 0, MaxBlockLength)), peer)
+	expectSent(messages.NewRejectRequest(1, 0, MaxBlockLength))
+
+	// The queue is bounded
+	for i := 0; i < PeerMaxQueuedRequests; i++ {
+		pm.processRequest(toMessage(request), peer)
+	}
+	expectSent()
+	pm.processRequest(toMessage(request), peer)
+	expectSent(reject)
+
+	// A cancelled request is removed from the queue
+	pm.processCancel(toMessage(messages.NewCancel(0, 0, MaxBlockLength)), peer)
+	expectSent(reject)
+	{
+		expected := PeerMaxQueuedRequests - 1
+		if value := len(peer.requests); value != expected {
+			t.Errorf("len(peer.requests) == %v, want %v", value, expected)
+		}
+	}
+
+	// The uploads wait for the peer to read the blocks
+	pm.serveRequests()
+	{
+		size := 4 + messages.PieceLength + MaxBlockLength
+		expected := (MaxQueuedPieceBytes + size - 1) / size
+		sent := sentMessages(t, peer)
+		if len(sent) != expected || torrent.Uploaded != expected*MaxBlockLength {
+			t.Errorf("Sent %v pieces, uploaded %v, want %v pieces", len(sent), torrent.Uploaded, expected)
+		}
+	}
+
+	// A request larger than MaxRequestLength drops the peer
+	pm.processRequest(toMessage(messages.NewRequest(0, 0, MaxRequestLength+1)), peer)
+	if _, ok := pm.Peers[peer.String()]; ok {
+		t.Errorf("Peer %v kept after requesting %v bytes", peer.String(), MaxRequestLength+1)
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	data := make([]byte, 2*MaxBlockLength)
+	torrent := newTestTorrent(t, data, MaxBlockLength)
+	pm := torrent.PeerManager
+
+	// The slow peer only has the first piece
+	slow, fast := newTestPeer(pm, "10.0.0.1:6881"), newTestPeer(pm, "10.0.0.2:6881")
+	slow.BitField().Set(0)
+	fast.BitField().Set(0)
+	fast.BitField().Set(1)
+	for _, peer := range []*Peer{slow, fast} {
+		pm.picker.AddBitField(peer.BitField())
+		peer.SetChoked(false)
+	}
+
+	pm.requestBlocks(slow)
+	if pm.endgame || slow.PendingCount() != 1 {
+		t.Fatalf("endgame == %v with %v pending, want false with 1 block pending", pm.endgame, slow.PendingCount())
+	}
+
+	// Once the last free block is requested, the outstanding ones are requested to everybody
+	pm.requestBlocks(fast)
+	if !pm.endgame || !fast.HasRequested(0, 0) || fast.PendingCount() != 2 {
+		t.Fatalf("endgame == %v with %v pending, want true with the block of piece #0 pending", pm.endgame, fast.PendingCount())
+	}
+
+	// The duplicates are cancelled as soon as the block arrives
+	sentMessages(t, slow)
+	pm.processPiece(toMessage(messages.NewPiece(0, 0, data[:MaxBlockLength])), fast)
+	if slow.HasRequested(0, 0) {
+		t.Errorf("The block of piece #0 is still requested to the slow peer")
+	}
+
+	cancelled := false
+	for _, message := range sentMessages(t, slow) {
+		if cancel, ok := message.(*messages.Cancel); ok && cancel.PieceIndex == 0 && cancel.BlockOffset == 0 {
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		t.Errorf("The block of piece #0 hasn't been cancelled")
+	}
+}
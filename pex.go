@@ -0,0 +1,244 @@
+package gotorrent
+
+import (
+	log "code.google.com/p/tcgl/applog"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	PexExtensionName = "ut_pex"
+	// PexInterval is how often the connected peers are sent to the other peers
+	PexInterval = time.Minute
+	// PexMaxPeers is the maximum number of added and of dropped peers in a message
+	PexMaxPeers = 50
+)
+
+// Flags of the added peers, see BEP 11
+const (
+	PexPrefersEncryption = 0x01
+	PexSeed              = 0x02
+	PexSupportsUTP       = 0x04
+	PexSupportsHolepunch = 0x08
+	PexReachable         = 0x10
+)
+
+func init() {
+	RegisterExtension(func(pm *PeerManager) Extension {
+		return NewPexExtension(pm)
+	})
+}
+
+// PexExtension implements Peer Exchange (BEP 11), every peer is sent
+// the peers we have connected to or disconnected from since its last message.
+type PexExtension struct {
+	pm       *PeerManager
+	lastSent time.Time
+	// The addresses each peer knows about, by peer
+	advertised map[*Peer]map[string]net.TCPAddr
+}
+
+func NewPexExtension(pm *PeerManager) *PexExtension {
+	e := new(PexExtension)
+	e.pm = pm
+	e.advertised = make(map[*Peer]map[string]net.TCPAddr)
+	return e
+}
+
+func (e *PexExtension) Name() string {
+	return PexExtensionName
+}
+
+func (e *PexExtension) ExtendHandshake(handshake map[string]interface{}) {
+	if e.pm.Torrent.Private {
+		if m, ok := handshake["m"].(map[string]interface{}); ok {
+			delete(m, PexExtensionName)
+		}
+	}
+}
+
+func (e *PexExtension) PeerHandshake(peer *Peer, handshake *ExtendedHandshake) {
+}
+
+func (e *PexExtension) HandleMessage(peer *Peer, payload []byte) error {
+	if e.pm.Torrent.Private {
+		return nil
+	}
+
+	dict, err := decodeDict(payload)
+	if err != nil {
+		return err
+	}
+
+	added, _ := dict["added"].(string)
+	added6, _ := dict["added6"].(string)
+	addrs := append(parseCompactPeers(added, net.IPv4len), parseCompactPeers(added6, net.IPv6len)...)
+	if len(addrs) > PexMaxPeers {
+		addrs = addrs[:PexMaxPeers]
+	}
+
+	log.Debugf("Peer %v - PEX, %v peers added", peer.String(), len(addrs))
+	for _, addr := range addrs {
+		e.pm.addPeer(addr, SourcePEX)
+	}
+	return nil
+}
+
+// Tick sends the changes to the connected peers once every PexInterval.
+func (e *PexExtension) Tick(now time.Time) {
+	if e.pm.Torrent.Private || now.Sub(e.lastSent) < PexInterval {
+		return
+	}
+	e.lastSent = now
+
+	current := make(map[string]net.TCPAddr)
+	flags := make(map[string]byte)
+	for _, peer := range e.pm.Peers {
+		if addr, ok := pexAddr(peer); ok {
+			current[addr.String()] = addr
+			flags[addr.String()] = pexFlags(peer)
+		}
+	}
+
+	for peer := range e.advertised {
+		if e.pm.Peers[peer.String()] != peer {
+			delete(e.advertised, peer)
+		}
+	}
+
+	for _, peer := range e.pm.Peers {
+		if !peer.SupportsExtension(PexExtensionName) {
+			continue
+		}
+
+		advertised, ok := e.advertised[peer]
+		if !ok {
+			advertised = make(map[string]net.TCPAddr)
+			e.advertised[peer] = advertised
+		}
+		self, _ := pexAddr(peer)
+
+		var added, dropped []net.TCPAddr
+		var addedFlags []byte
+		for key, addr := range current {
+			if _, ok := advertised[key]; !ok && key != self.String() && len(added) < PexMaxPeers {
+				added = append(added, addr)
+				addedFlags = append(addedFlags, flags[key])
+			}
+		}
+		for key, addr := range advertised {
+			if _, ok := current[key]; !ok && len(dropped) < PexMaxPeers {
+				dropped = append(dropped, addr)
+			}
+		}
+
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		if e.send(peer, added, addedFlags, dropped) {
+			for _, addr := range added {
+				advertised[addr.String()] = addr
+			}
+			for _, addr := range dropped {
+				delete(advertised, addr.String())
+			}
+		}
+	}
+}
+
+func (e *PexExtension) send(peer *Peer, added []net.TCPAddr, addedFlags []byte, dropped []net.TCPAddr) bool {
+	var added4, added6, flags4, flags6, dropped4, dropped6 []byte
+	for i, addr := range added {
+		if compact := compactPeer(addr); len(compact) == net.IPv4len+2 {
+			added4 = append(added4, compact...)
+			flags4 = append(flags4, addedFlags[i])
+		} else {
+			added6 = append(added6, compact...)
+			flags6 = append(flags6, addedFlags[i])
+		}
+	}
+	for _, addr := range dropped {
+		if compact := compactPeer(addr); len(compact) == net.IPv4len+2 {
+			dropped4 = append(dropped4, compact...)
+		} else {
+			dropped6 = append(dropped6, compact...)
+		}
+	}
+
+	payload, err := encodeDict(map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(flags4),
+		"dropped":  string(dropped4),
+		"added6":   string(added6),
+		"added6.f": string(flags6),
+		"dropped6": string(dropped6),
+	})
+	if err != nil {
+		log.Errorf("Peer %v - Unable to encode the PEX message: %v", peer.String(), err)
+		return false
+	}
+
+	log.Debugf("Peer %v - PEX, %v added, %v dropped", peer.String(), len(added), len(dropped))
+	return peer.SendExtension(PexExtensionName, payload)
+}
+
+// pexAddr returns the address the peer accepts connections on,
+// which is unknown for an incoming peer that hasn't told its port.
+func pexAddr(peer *Peer) (addr net.TCPAddr, ok bool) {
+	addr = peer.connection.addr
+	if !peer.Incoming {
+		return addr, true
+	}
+	if peer.ExtendedHandshake == nil || peer.ExtendedHandshake.P <= 0 {
+		return addr, false
+	}
+	addr.Port = peer.ExtendedHandshake.P
+	return addr, true
+}
+
+func pexFlags(peer *Peer) (flags byte) {
+	if peer.Encrypted {
+		flags |= PexPrefersEncryption
+	}
+	if peer.IsSeed() {
+		flags |= PexSeed
+	}
+	if peer.UTP {
+		flags |= PexSupportsUTP
+	}
+	if !peer.Incoming {
+		flags |= PexReachable
+	}
+	return
+}
+
+// compactPeer encodes an address in the compact format: the IP address
+// followed by the port, in network byte order.
+func compactPeer(addr net.TCPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(addr.Port))
+	return compact
+}
+
+// parseCompactPeers decodes a list of compact addresses,
+// ipLen is 4 for IPv4 addresses and 16 for IPv6 ones.
+func parseCompactPeers(data string, ipLen int) (peers []net.TCPAddr) {
+	size := ipLen + 2
+	for i := 0; i+size <= len(data); i += size {
+		ip := make(net.IP, ipLen)
+		copy(ip, data[i:i+ipLen])
+		port := binary.BigEndian.Uint16([]byte(data[i+ipLen : i+size]))
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, net.TCPAddr{IP: ip, Port: int(port)})
+	}
+	return
+}
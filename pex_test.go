@@ -0,0 +1,29 @@
+package gotorrent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCompactPeers(t *testing.T) {
+	addrs := []net.TCPAddr{
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 51413},
+	}
+
+	for _, addr := range addrs {
+		compact := compactPeer(addr)
+		ipLen := len(compact) - 2
+
+		peers := parseCompactPeers(string(compact), ipLen)
+		if len(peers) != 1 {
+			t.Fatalf("parseCompactPeers(%x) == %v, want [%v]", compact, peers, addr)
+		}
+
+		expected := addr.String()
+		value := peers[0].String()
+		if value != expected {
+			t.Errorf("parseCompactPeers(compactPeer(%v)) == %v, want %v", addr, value, expected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package gotorrent
+
+import (
+	"github.com/moretti/gotorrent/bitarray"
+	"math/rand"
+)
+
+// DownloadStrategy decides the order in which the pieces are downloaded.
+type DownloadStrategy int
+
+const (
+	// RarestFirst downloads the pieces that fewer peers have first
+	RarestFirst DownloadStrategy = iota
+	// Sequential downloads the pieces in order
+	Sequential
+	// FileEndsFirst is RarestFirst, except that the first and the last piece
+	// of every file come first. Many formats keep their index at either end.
+	FileEndsFirst
+)
+
+func (strategy DownloadStrategy) String() string {
+	switch strategy {
+	case RarestFirst:
+		return "rarest-first"
+	case Sequential:
+		return "sequential"
+	case FileEndsFirst:
+		return "file-ends-first"
+	}
+	return "unknown"
+}
+
+// PiecePicker keeps track of how many peers have each piece,
+// so that the rarest pieces are downloaded first.
+type PiecePicker struct {
+	availability []int
+	// fileEnds are the first and last pieces of every file
+	fileEnds *bitarray.BitArray
+}
+
+func NewPiecePicker(pieceCount int, fileEnds []int) *PiecePicker {
+	pp := new(PiecePicker)
+	pp.availability = make([]int, pieceCount)
+	pp.fileEnds = bitarray.New(pieceCount)
+	for _, index := range fileEnds {
+		if index >= 0 && index < pieceCount {
+			pp.fileEnds.Set(index)
+		}
+	}
+	return pp
+}
+
+// AddBitField counts the pieces of a new peer.
+func (pp *PiecePicker) AddBitField(bitField *bitarray.BitArray) {
+	for _, index := range bitField.SetIndices() {
+		pp.availability[index]++
+	}
+}
+
+// RemoveBitField forgets the pieces of a peer, i.e. when it disconnects.
+func (pp *PiecePicker) RemoveBitField(bitField *bitarray.BitArray) {
+	for _, index := range bitField.SetIndices() {
+		pp.availability[index]--
+	}
+}
+
+// AddPiece counts a piece announced by a Have message.
+func (pp *PiecePicker) AddPiece(index int) {
+	pp.availability[index]++
+}
+
+func (pp *PiecePicker) Availability(index int) int {
+	return pp.availability[index]
+}
+
+// Pick returns the position in pieceIndices of the piece to download next,
+// according to the strategy. Rarest pieces are preferred, ties are broken at random.
+// When random is true any piece can be chosen, a complete piece is more
+// valuable than a rare one as long as we have nothing to share.
+func (pp *PiecePicker) Pick(pieceIndices []int, strategy DownloadStrategy, random bool) int {
+	switch strategy {
+	case Sequential:
+		return pp.pickFirst(pieceIndices)
+	case FileEndsFirst:
+		if i := pp.pickFileEnd(pieceIndices); i != -1 {
+			return i
+		}
+	}
+
+	if random {
+		return rand.Intn(len(pieceIndices))
+	}
+	return pp.pickRarest(pieceIndices)
+}
+
+func (pp *PiecePicker) pickFirst(pieceIndices []int) int {
+	first := 0
+	for i, index := range pieceIndices {
+		if index < pieceIndices[first] {
+			first = i
+		}
+	}
+	return first
+}
+
+func (pp *PiecePicker) pickFileEnd(pieceIndices []int) int {
+	for i, index := range pieceIndices {
+		if pp.fileEnds.IsSet(index) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (pp *PiecePicker) pickRarest(pieceIndices []int) int {
+	best := -1
+	ties := 0
+	for i, index := range pieceIndices {
+		switch {
+		case best == -1 || pp.availability[index] < pp.availability[pieceIndices[best]]:
+			best = i
+			ties = 1
+		case pp.availability[index] == pp.availability[pieceIndices[best]]:
+			// Reservoir sampling, every tie has the same probability of being chosen
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,129 @@
+package gotorrent
+
+import (
+	"github.com/moretti/gotorrent/bitarray"
+	"github.com/moretti/gotorrent/metainfo"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPickRarest(t *testing.T) {
+	pp := NewPiecePicker(5, nil)
+	pp.AddBitField(bitarray.NewFromString("11111"))
+	pp.AddBitField(bitarray.NewFromString("11011"))
+	pp.AddBitField(bitarray.NewFromString("10010"))
+	pp.AddPiece(4)
+
+	{
+		expected := []int{3, 2, 1, 3, 3}
+		for i, e := range expected {
+			value := pp.Availability(i)
+			if value != e {
+				t.Errorf("pp.Availability(%v) == %v, want %v", i, value, e)
+			}
+		}
+	}
+
+	// Piece #2 is the rarest
+	{
+		pieceIndices := []int{0, 1, 2, 3, 4}
+		expected := 2
+		value := pp.Pick(pieceIndices, RarestFirst, false)
+		if value != expected {
+			t.Errorf("pp.Pick(%v) == %v, want %v", pieceIndices, value, expected)
+		}
+	}
+
+	// Pieces #1 and #2 are tied once another peer has piece #2
+	{
+		pp.AddBitField(bitarray.NewFromString("00100"))
+		pieceIndices := []int{0, 1, 2, 3}
+		for i := 0; i < 10; i++ {
+			value := pp.Pick(pieceIndices, RarestFirst, false)
+			if value != 1 && value != 2 {
+				t.Errorf("pp.Pick(%v) == %v, want 1 or 2", pieceIndices, value)
+			}
+		}
+	}
+
+	{
+		pp.RemoveBitField(bitarray.NewFromString("11111"))
+		expected := []int{2, 1, 1, 2, 2}
+		for i, e := range expected {
+			value := pp.Availability(i)
+			if value != e {
+				t.Errorf("pp.Availability(%v) == %v, want %v", i, value, e)
+			}
+		}
+	}
+}
+
+func TestPickStrategy(t *testing.T) {
+	pp := NewPiecePicker(10, []int{0, 4, 5, 9})
+	pp.AddBitField(bitarray.NewFromString("1111111111"))
+	pp.AddBitField(bitarray.NewFromString("0000001100"))
+
+	pieceIndices := []int{8, 3, 6, 9, 2}
+
+	{
+		expected := 4
+		value := pp.Pick(pieceIndices, Sequential, false)
+		if value != expected {
+			t.Errorf("pp.Pick(%v, Sequential) == %v, want %v", pieceIndices, value, expected)
+		}
+	}
+
+	{
+		expected := 3
+		value := pp.Pick(pieceIndices, FileEndsFirst, false)
+		if value != expected {
+			t.Errorf("pp.Pick(%v, FileEndsFirst) == %v, want %v", pieceIndices, value, expected)
+		}
+	}
+
+	// Without file ends left it falls back to rarest first
+	{
+		pieceIndices := []int{6, 7, 8}
+		expected := 2
+		value := pp.Pick(pieceIndices, FileEndsFirst, false)
+		if value != expected {
+			t.Errorf("pp.Pick(%v, FileEndsFirst) == %v, want %v", pieceIndices, value, expected)
+		}
+	}
+}
+
+func TestFileEnds(t *testing.T) {
+	// The length of a multi-file torrent is the sum of its files
+	torrent := new(Torrent)
+	info := &metainfo.InfoDict{
+		PieceLength: MaxBlockLength,
+		Pieces:      strings.Repeat("h", 5*20),
+		Files: []metainfo.FileDict{
+			{Length: 3 * MaxBlockLength},
+			{Length: 0},
+			{Length: MaxBlockLength + 1},
+		},
+	}
+	if err := torrent.SetInfo(info, "info"); err != nil {
+		t.Fatalf("SetInfo() returned %v", err)
+	}
+
+	{
+		expected := []int{0, 2, 3, 4}
+		value := torrent.FileEnds()
+		if !reflect.DeepEqual(value, expected) {
+			t.Errorf("FileEnds() == %v, want %v", value, expected)
+		}
+	}
+
+	// The indices out of range are ignored
+	pp := NewPiecePicker(3, []int{0, 2, 5})
+	{
+		expected := 1
+		value := pp.Pick([]int{1, 2}, FileEndsFirst, false)
+		if value != expected {
+			t.Errorf("pp.Pick([1 2], FileEndsFirst) == %v, want %v", value, expected)
+		}
+	}
+}
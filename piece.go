@@ -3,10 +3,16 @@ package gotorrent
 import (
 	log "code.google.com/p/tcgl/applog"
 	"crypto/sha1"
+	"errors"
 	"github.com/moretti/gotorrent/bitarray"
 )
 
+var ErrInvalidBlock = errors.New("Invalid block")
+
 const (
+	// MaxRequestLength is the largest block we are willing to upload in a single message.
+	MaxRequestLength = 1024 * 128
+
 	// MaxBlockLength is generally a power of two unless it gets truncated by the end of the file.
 	// All current implementations use 2 15 (32 KB), and close connections which request an amount greater than 2 17.
 	MaxBlockLength = 1024 * 16
@@ -20,9 +26,11 @@ const (
 type Piece struct {
 	completed *bitarray.BitArray
 	requested *bitarray.BitArray
-	hash      string
-	index     int
-	length    int
+	// owners tracks the peer each requested block has been asked to
+	owners []*Peer
+	hash   string
+	index  int
+	length int
 
 	data []byte
 }
@@ -30,8 +38,10 @@ type Piece struct {
 func NewPiece(index, length int, hash string) *Piece {
 	p := new(Piece)
 
-	p.completed = bitarray.New(length / MaxBlockLength)
-	p.requested = bitarray.New(p.completed.Len())
+	blockCount := (length + MaxBlockLength - 1) / MaxBlockLength
+	p.completed = bitarray.New(blockCount)
+	p.requested = bitarray.New(blockCount)
+	p.owners = make([]*Peer, blockCount)
 
 	p.hash = hash
 	p.index = index
@@ -42,25 +52,43 @@ func NewPiece(index, length int, hash string) *Piece {
 	return p
 }
 
-func (p *Piece) SetBlock(begin int, block []byte) {
+// SetBlock stores a downloaded block, it returns false when the block
+// is invalid or has already been downloaded.
+func (p *Piece) SetBlock(begin int, block []byte) bool {
 	index := begin / MaxBlockLength
+	if begin < 0 || begin%MaxBlockLength != 0 || index >= p.completed.Len() || len(block) != p.blockLength(index) {
+		log.Warningf("Invalid block at piece %v, offset %v, length %v", p.index, begin, len(block))
+		return false
+	}
+
 	if p.completed.IsSet(index) {
 		log.Warningf("Attempt to overwrite data at piece %v, offset %v", p.index, begin)
-		return
+		return false
 	}
 
-	end := begin + len(block)
+	copy(p.data[begin:begin+len(block)], block)
+	p.completed.Set(index)
+	p.owners[index] = nil
+	return true
+}
 
-	if end > len(p.data) || begin < 0 {
-		log.Warningf("Len of block: %v", len(block))
-		log.Warningf("Index: %v", index)
-		log.Warningf("len(data): %v", len(p.data))
-		log.Warningf("Begin: %v", begin)
-		log.Warningf("End: %v", end)
+// ReleaseBlock makes a block requested to owner available to be requested again.
+// It does nothing if the block has been requested to someone else in the meantime.
+func (p *Piece) ReleaseBlock(begin int, owner *Peer) {
+	index := begin / MaxBlockLength
+	if index < 0 || index >= p.requested.Len() || p.completed.IsSet(index) || p.owners[index] != owner {
+		return
 	}
 
-	copy(p.data[begin:end], block)
-	p.completed.Set(index)
+	p.requested.Unset(index)
+	p.owners[index] = nil
+}
+
+func (p *Piece) blockLength(index int) int {
+	if lastLength := p.length % MaxBlockLength; index == p.completed.Len()-1 && lastLength != 0 {
+		return lastLength
+	}
+	return MaxBlockLength
 }
 
 type BlockRequest struct {
@@ -68,7 +96,8 @@ type BlockRequest struct {
 	Length int
 }
 
-func (p *Piece) NextBlock() *BlockRequest {
+// NextBlock marks the first free block as requested to owner.
+func (p *Piece) NextBlock(owner *Peer) *BlockRequest {
 	if p.completed.Cardinality() == p.completed.Len() {
 		return nil
 	}
@@ -80,18 +109,51 @@ func (p *Piece) NextBlock() *BlockRequest {
 
 	index := indices[0]
 	p.requested.Set(index)
-	lastLength := p.length % MaxBlockLength
+	p.owners[index] = owner
 
 	blockRequest := new(BlockRequest)
 	blockRequest.Begin = index * MaxBlockLength
+	blockRequest.Length = p.blockLength(index)
 
-	if index == p.completed.Len()-1 && lastLength != 0 {
-		blockRequest.Length = lastLength
-	} else {
-		blockRequest.Length = MaxBlockLength
+	return blockRequest
+}
+
+// HasFreeBlock returns true if some blocks have been neither requested nor downloaded.
+func (p *Piece) HasFreeBlock() bool {
+	return p.requested.Or(p.completed).Cardinality() < p.completed.Len()
+}
+
+// OutstandingBlocks returns the blocks that have been requested but not yet downloaded.
+func (p *Piece) OutstandingBlocks() (blocks []*BlockRequest) {
+	for _, index := range p.requested.And(p.completed.Xor(p.requested)).SetIndices() {
+		blocks = append(blocks, &BlockRequest{
+			Begin:  index * MaxBlockLength,
+			Length: p.blockLength(index),
+		})
 	}
+	return
+}
 
-	return blockRequest
+// Block returns the data stored between begin and begin+length.
+func (p *Piece) Block(begin, length int) (block []byte, err error) {
+	if begin < 0 || length <= 0 || begin+length > p.length {
+		err = ErrInvalidBlock
+		return
+	}
+
+	block = p.data[begin : begin+length]
+	return
+}
+
+func (p *Piece) IsComplete() bool {
+	return p.completed.Cardinality() == p.completed.Len()
+}
+
+// Reset discards the downloaded blocks, i.e. after a failed hash check.
+func (p *Piece) Reset() {
+	p.completed = bitarray.New(p.completed.Len())
+	p.requested = bitarray.New(p.completed.Len())
+	p.owners = make([]*Peer, p.completed.Len())
 }
 
 func (p *Piece) IsValid() bool {
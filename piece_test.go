@@ -0,0 +1,88 @@
+package gotorrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPieceSizes(t *testing.T) {
+	tests := []struct {
+		length      int
+		pieceLength int
+		pieceCount  int
+		// lastBlocks are the blocks of the last piece
+		lastBlocks []int
+	}{
+		{2 * 3 * MaxBlockLength, 3 * MaxBlockLength, 2, []int{MaxBlockLength, MaxBlockLength, MaxBlockLength}},
+		// The last piece and its last block are truncated
+		{3*MaxBlockLength + MaxBlockLength + 100, 3 * MaxBlockLength, 2, []int{MaxBlockLength, 100}},
+		{3*MaxBlockLength + 1, 3 * MaxBlockLength, 2, []int{1}},
+		// A piece length which isn't a multiple of the block length
+		{2 * 20000, 20000, 2, []int{MaxBlockLength, 20000 - MaxBlockLength}},
+	}
+
+	for _, test := range tests {
+		torrent := new(Torrent)
+		info, infoBytes := testInfo(make([]byte, test.length), test.pieceLength)
+		if err := torrent.SetInfo(info, string(infoBytes)); err != nil {
+			t.Fatalf("SetInfo() returned %v", err)
+		}
+		if torrent.PieceCount != test.pieceCount {
+			t.Errorf("PieceCount == %v for %v bytes, want %v", torrent.PieceCount, test.length, test.pieceCount)
+			continue
+		}
+
+		last := torrent.Pieces[torrent.PieceCount-1]
+		var blocks []int
+		for block := last.NextBlock(nil); block != nil; block = last.NextBlock(nil) {
+			blocks = append(blocks, block.Length)
+		}
+		if !reflect.DeepEqual(blocks, test.lastBlocks) {
+			t.Errorf("Blocks of the last piece of %v bytes == %v, want %v", test.length, blocks, test.lastBlocks)
+		}
+
+		expected := test.length - (torrent.PieceCount-1)*test.pieceLength
+		if value := last.Len(); value != expected {
+			t.Errorf("Length of the last piece of %v bytes == %v, want %v", test.length, value, expected)
+		}
+	}
+}
+
+func TestReleaseBlock(t *testing.T) {
+	piece := NewPiece(0, 2*MaxBlockLength, "")
+	owner, other := new(Peer), new(Peer)
+
+	first := piece.NextBlock(owner)
+	second := piece.NextBlock(owner)
+	if piece.HasFreeBlock() {
+		t.Fatalf("HasFreeBlock() == true with every block requested")
+	}
+
+	// Only the peer the block has been requested to can release it
+	piece.ReleaseBlock(first.Begin, other)
+	if piece.HasFreeBlock() {
+		t.Errorf("HasFreeBlock() == true after a release by another peer")
+	}
+
+	piece.ReleaseBlock(first.Begin, owner)
+	if !piece.HasFreeBlock() {
+		t.Fatalf("HasFreeBlock() == false after a release by the owner")
+	}
+
+	// The released block is requested again, the late release of its
+	// previous owner is then ignored
+	if block := piece.NextBlock(other); block == nil || block.Begin != first.Begin {
+		t.Fatalf("NextBlock() == %v, want the block at %v", block, first.Begin)
+	}
+	piece.ReleaseBlock(first.Begin, owner)
+	if piece.HasFreeBlock() {
+		t.Errorf("HasFreeBlock() == true after a release by the previous owner")
+	}
+
+	// A downloaded block stays downloaded
+	piece.SetBlock(second.Begin, make([]byte, second.Length))
+	piece.ReleaseBlock(second.Begin, owner)
+	if blocks := piece.OutstandingBlocks(); len(blocks) != 1 || blocks[0].Begin != first.Begin {
+		t.Errorf("OutstandingBlocks() == %v, want the block at %v", blocks, first.Begin)
+	}
+}
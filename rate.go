@@ -0,0 +1,56 @@
+package gotorrent
+
+import (
+	"time"
+)
+
+const (
+	// RateWindow is the number of seconds a transfer rate is averaged over
+	RateWindow = 20
+)
+
+// Rate measures a transfer rate using a rolling window of one second buckets.
+type Rate struct {
+	buckets [RateWindow]int
+	seconds [RateWindow]int64
+	total   int
+}
+
+func NewRate() *Rate {
+	return new(Rate)
+}
+
+// Add records n transferred bytes.
+func (r *Rate) Add(n int) {
+	r.add(time.Now().Unix(), n)
+}
+
+func (r *Rate) add(now int64, n int) {
+	i := now % RateWindow
+	if r.seconds[i] != now {
+		r.seconds[i] = now
+		r.buckets[i] = 0
+	}
+	r.buckets[i] += n
+	r.total += n
+}
+
+// Rate returns the average number of bytes per second over the last RateWindow seconds.
+func (r *Rate) Rate() float64 {
+	return r.rate(time.Now().Unix())
+}
+
+func (r *Rate) rate(now int64) float64 {
+	sum := 0
+	for i := range r.buckets {
+		if now-r.seconds[i] < RateWindow {
+			sum += r.buckets[i]
+		}
+	}
+	return float64(sum) / RateWindow
+}
+
+// Total returns the number of bytes transferred since the rate was created.
+func (r *Rate) Total() int {
+	return r.total
+}
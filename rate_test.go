@@ -0,0 +1,48 @@
+package gotorrent
+
+import (
+	"testing"
+)
+
+func TestRate(t *testing.T) {
+	r := NewRate()
+
+	r.add(100, 1000)
+	r.add(100, 1000)
+	r.add(105, 2000)
+
+	{
+		expected := float64(4000) / RateWindow
+		value := r.rate(105)
+		if value != expected {
+			t.Errorf("r.rate(105) == %v, want %v", value, expected)
+		}
+	}
+
+	// Old buckets fall out of the window
+	{
+		expected := float64(2000) / RateWindow
+		value := r.rate(100 + RateWindow)
+		if value != expected {
+			t.Errorf("r.rate(%v) == %v, want %v", 100+RateWindow, value, expected)
+		}
+	}
+
+	// A bucket is reused once the window wraps around
+	{
+		r.add(100+RateWindow, 500)
+		expected := float64(2500) / RateWindow
+		value := r.rate(100 + RateWindow)
+		if value != expected {
+			t.Errorf("r.rate(%v) == %v, want %v", 100+RateWindow, value, expected)
+		}
+	}
+
+	{
+		expected := 4500
+		value := r.Total()
+		if value != expected {
+			t.Errorf("r.Total() == %v, want %v", value, expected)
+		}
+	}
+}
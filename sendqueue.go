@@ -0,0 +1,134 @@
+package gotorrent
+
+import (
+	"errors"
+	"github.com/moretti/gotorrent/messages"
+	"sync"
+)
+
+const (
+	// MaxQueuedMessages bounds the messages other than pieces waiting to be
+	// written, a peer falling that far behind is disconnected
+	MaxQueuedMessages = 1024
+	// MaxQueuedPieceBytes is the upload data queued per connection, the
+	// remaining requests are served as the peer reads the blocks
+	MaxQueuedPieceBytes = 16 * MaxBlockLength
+	// MaxBatchLength bounds the small messages sent in a single write
+	MaxBatchLength = 16 * 1024
+)
+
+var ErrSendQueueFull = errors.New("Send queue full")
+
+type queuedMessage struct {
+	message interface{}
+	data    []byte
+}
+
+// sendQueue holds the outgoing messages of a connection. The messages are
+// marshaled when queued and written in order, except the pieces which
+// wait for the other messages to be sent.
+type sendQueue struct {
+	lock       sync.Mutex
+	control    []queuedMessage
+	pieces     []queuedMessage
+	pieceBytes int
+	err        error
+
+	// ready is signaled when messages are queued
+	ready chan struct{}
+}
+
+func newSendQueue() *sendQueue {
+	q := new(sendQueue)
+	q.ready = make(chan struct{}, 1)
+	return q
+}
+
+// Push queues a message, it never blocks. A full queue fails the
+// connection, the error is returned by the following calls to Next.
+func (q *sendQueue) Push(message interface{}) (err error) {
+	data, err := messages.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.err != nil {
+		return q.err
+	}
+
+	if _, ok := message.(*messages.Piece); ok {
+		q.pieces = append(q.pieces, queuedMessage{message, data})
+		q.pieceBytes += len(data)
+	} else if len(q.control) >= MaxQueuedMessages {
+		q.err = ErrSendQueueFull
+		err = q.err
+	} else {
+		q.control = append(q.control, queuedMessage{message, data})
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// Next dequeues the data of the next write: as many small messages as fit
+// in a batch, a piece when there are none, nil when the queue is empty.
+func (q *sendQueue) Next() (data []byte, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	if len(q.control) > 0 {
+		n := 0
+		for _, queued := range q.control {
+			if n > 0 && len(data)+len(queued.data) > MaxBatchLength {
+				break
+			}
+			data = append(data, queued.data...)
+			n++
+		}
+		q.control = q.control[n:]
+		return
+	}
+
+	if len(q.pieces) > 0 {
+		data = q.pieces[0].data
+		q.pieces = q.pieces[1:]
+		q.pieceBytes -= len(data)
+	}
+	return
+}
+
+// CancelRequest removes a Request which hasn't been sent yet,
+// it returns false if it's not in the queue.
+func (q *sendQueue) CancelRequest(pieceIndex, blockOffset, blockLength uint32) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, queued := range q.control {
+		request, ok := queued.message.(*messages.Request)
+		if ok && request.PieceIndex == pieceIndex &&
+			request.BlockOffset == blockOffset &&
+			request.BlockLength == blockLength {
+			q.control = append(q.control[:i], q.control[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// PieceBytes returns the length of the queued pieces.
+func (q *sendQueue) PieceBytes() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.pieceBytes
+}
@@ -0,0 +1,60 @@
+package gotorrent
+
+import (
+	"bytes"
+	"github.com/moretti/gotorrent/messages"
+	"testing"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue()
+	block := bytes.Repeat([]byte{0xab}, MaxBlockLength)
+
+	q.Push(messages.NewPiece(0, 0, block))
+	q.Push(messages.NewInterested())
+	q.Push(messages.NewRequest(1, 0, MaxBlockLength))
+	q.Push(messages.NewRequest(1, MaxBlockLength, MaxBlockLength))
+
+	if !q.CancelRequest(1, 0, MaxBlockLength) {
+		t.Errorf("CancelRequest() == false, want true")
+	}
+	if q.CancelRequest(2, 0, MaxBlockLength) {
+		t.Errorf("CancelRequest() == true for a request never queued, want false")
+	}
+
+	// The small messages go first, in a single write
+	{
+		interested, _ := messages.Marshal(messages.NewInterested())
+		request, _ := messages.Marshal(messages.NewRequest(1, MaxBlockLength, MaxBlockLength))
+		expected := append(interested, request...)
+		value, _ := q.Next()
+		if !bytes.Equal(value, expected) {
+			t.Errorf("q.Next() == %x, want %x", value, expected)
+		}
+	}
+
+	{
+		expected := messages.PieceLength + MaxBlockLength + 4
+		if value := q.PieceBytes(); value != expected {
+			t.Errorf("q.PieceBytes() == %v, want %v", value, expected)
+		}
+		data, _ := q.Next()
+		if value := len(data); value != expected {
+			t.Errorf("len(q.Next()) == %v, want %v", value, expected)
+		}
+	}
+
+	if value, err := q.Next(); value != nil || err != nil {
+		t.Errorf("q.Next() == %x, %v, want nil", value, err)
+	}
+
+	for i := 0; i < MaxQueuedMessages; i++ {
+		q.Push(messages.NewHave(uint32(i)))
+	}
+	if err := q.Push(messages.NewHave(0)); err != ErrSendQueueFull {
+		t.Errorf("q.Push() returned %v, want %v", err, ErrSendQueueFull)
+	}
+	if _, err := q.Next(); err != ErrSendQueueFull {
+		t.Errorf("q.Next() returned %v, want %v", err, ErrSendQueueFull)
+	}
+}
@@ -2,13 +2,24 @@ package gotorrent
 
 import (
 	log "code.google.com/p/tcgl/applog"
+	"errors"
 	"github.com/moretti/gotorrent/bitarray"
+	"github.com/moretti/gotorrent/dht"
+	"github.com/moretti/gotorrent/ipfilter"
 	"github.com/moretti/gotorrent/metainfo"
+	"github.com/moretti/gotorrent/mse"
+	"github.com/moretti/gotorrent/utp"
+	"net"
 	"os"
 	"strings"
 	"time"
 )
 
+var (
+	ErrInvalidInfo    = errors.New("Invalid info dictionary")
+	ErrNotImplemented = errors.New("Not implemented")
+)
+
 type Torrent struct {
 	ClientId     ClientId
 	Port         int
@@ -17,6 +28,14 @@ type Torrent struct {
 	Downloaded int
 	Uploaded   int
 
+	// UploadSlots is the number of peers unchoked at the same time,
+	// it's read by the choker every ChokeInterval
+	UploadSlots int
+	// Strategy is the order in which the pieces are downloaded
+	Strategy DownloadStrategy
+	// PeerTimeout is how long a peer can stay silent before being disconnected
+	PeerTimeout time.Duration
+
 	Pieces      []*Piece
 	PeerManager *PeerManager
 	Tracker     *Tracker
@@ -32,87 +51,210 @@ type Torrent struct {
 	PieceHashes  string
 	PieceLength  int
 	PieceCount   int
+	FileLengths  []int
+	// Private torrents only get peers from their trackers, see BEP 27
+	Private bool
+	// DHT is shared by the torrents of the client, nil if disabled
+	DHT *dht.DHT
+	// Encryption is the Message Stream Encryption policy of the connections
+	Encryption mse.Policy
+	// UTP are the sockets of the client the uTP connections are dialed from,
+	// one per address family, DialPolicy tells whether uTP is tried before TCP
+	UTP        []*utp.Socket
+	DialPolicy DialPolicy
+	// IPv6 is our address reported to the tracker, nil if unknown
+	IPv6 net.IP
+	// MaxConnections bounds the peers of the torrent, Limiter the
+	// connections of all the torrents of the client
+	MaxConnections int
+	Limiter        *ConnectionLimiter
+	// IPFilter is the blocklist of the client, nil if disabled
+	IPFilter *ipfilter.Filter
+	// InfoBytes is the bencoded info dictionary, it's empty until
+	// the metadata of a magnet link has been downloaded
+	InfoBytes string
 }
 
-func NewTorrent(clientId ClientId, port int, torrent string, downloadPath string) *Torrent {
-	t := new(Torrent)
+// NewTorrent creates a torrent from a .torrent file or a magnet link, its
+// connections count against limiter which is shared by the torrents of a client.
+// The peer manager is started by PeerManager.Start.
+func NewTorrent(clientId ClientId, port int, torrent string, downloadPath string, limiter *ConnectionLimiter) (t *Torrent, err error) {
+	t = new(Torrent)
 	t.ClientId = clientId
 	t.Port = port
 	t.DownloadPath = downloadPath
 	t.Downloaded = 0
 	t.Uploaded = 0
+	t.UploadSlots = DefaultUploadSlots
+	t.Strategy = RarestFirst
+	t.PeerTimeout = DefaultPeerTimeout
+	t.Encryption = mse.Preferred
+	t.MaxConnections = DefaultMaxTorrentConnections
+	t.Limiter = limiter
 
-	metaInfo := readTorrent(torrent)
+	if strings.HasPrefix(torrent, "magnet:") {
+		magnet, err := ParseMagnet(torrent)
+		if err != nil {
+			return nil, err
+		}
 
-	t.Announce = metaInfo.Announce
-	t.InfoHash = metaInfo.InfoHash
-	t.CreationDate = metaInfo.CreationDate
-	t.Name = metaInfo.Info.Name
-	t.Length = metaInfo.Info.Length
-	t.PieceHashes = metaInfo.Info.Pieces
-	t.PieceLength = metaInfo.Info.PieceLength
-	t.PieceCount = t.Length / t.PieceLength
+		// The rest of the metadata is downloaded from the peers
+		t.InfoHash = magnet.InfoHash
+		t.Name = magnet.Name
+		if len(magnet.Trackers) > 0 {
+			t.Announce = magnet.Trackers[0]
+		}
+		t.ActivePieces = bitarray.New(0)
+		t.CompletedPieces = bitarray.New(0)
+	} else {
+		metaInfo, err := readTorrent(torrent)
+		if err != nil {
+			return nil, err
+		}
 
-	t.Pieces = make([]*Piece, t.PieceCount)
-	for i := 0; i < t.PieceCount; i++ {
-		hashIndex := i * 20
-		t.Pieces[i] = NewPiece(i, t.PieceLength, t.PieceHashes[hashIndex:hashIndex+20])
+		t.Announce = metaInfo.Announce
+		t.InfoHash = metaInfo.InfoHash
+		t.CreationDate = metaInfo.CreationDate
+		if err = t.SetInfo(&metaInfo.Info, metaInfo.InfoBytes); err != nil {
+			return nil, err
+		}
 	}
 
-	t.ActivePieces = bitarray.New(t.PieceCount)
-	t.CompletedPieces = bitarray.New(t.PieceCount)
 	t.Tracker = NewTracker(t.Announce)
 	t.PeerManager = NewPeerManager(t)
 
-	log.Debugf("File Length: %v", t.Length)
-	log.Debugf("Piece Length: %v", t.PieceLength)
-	log.Debugf("Piece Count: %v", t.PieceCount)
-	log.Debugf("Piece Hashes: %v", len(t.PieceHashes))
+	return
+}
+
+// SetInfo initializes the pieces from the info dictionary.
+func (torrent *Torrent) SetInfo(info *metainfo.InfoDict, infoBytes string) error {
+	if info.PieceLength <= 0 || len(info.Pieces)%20 != 0 {
+		return ErrInvalidInfo
+	}
+
+	torrent.InfoBytes = infoBytes
+	torrent.Name = info.Name
+	torrent.Length = info.Length
+	torrent.PieceHashes = info.Pieces
+	torrent.PieceLength = info.PieceLength
+	torrent.Private = info.Private == 1
+	torrent.FileLengths = []int{torrent.Length}
+	if len(info.Files) > 0 {
+		torrent.Length = 0
+		torrent.FileLengths = make([]int, len(info.Files))
+		for i, file := range info.Files {
+			torrent.FileLengths[i] = file.Length
+			torrent.Length += file.Length
+		}
+	}
+	torrent.PieceCount = (torrent.Length + torrent.PieceLength - 1) / torrent.PieceLength
+	if torrent.PieceCount != len(torrent.PieceHashes)/20 {
+		return ErrInvalidInfo
+	}
+
+	torrent.Pieces = make([]*Piece, torrent.PieceCount)
+	for i := 0; i < torrent.PieceCount; i++ {
+		hashIndex := i * 20
+		pieceLength := torrent.PieceLength
+		// The last piece is usually truncated
+		if i == torrent.PieceCount-1 && torrent.Length%torrent.PieceLength != 0 {
+			pieceLength = torrent.Length % torrent.PieceLength
+		}
+		torrent.Pieces[i] = NewPiece(i, pieceLength, torrent.PieceHashes[hashIndex:hashIndex+20])
+	}
+
+	torrent.ActivePieces = bitarray.New(torrent.PieceCount)
+	torrent.CompletedPieces = bitarray.New(torrent.PieceCount)
 
-	return t
+	log.Debugf("File Length: %v", torrent.Length)
+	log.Debugf("Piece Length: %v", torrent.PieceLength)
+	log.Debugf("Piece Count: %v", torrent.PieceCount)
+	log.Debugf("Piece Hashes: %v", len(torrent.PieceHashes))
+	return nil
 }
 
-func readTorrent(torrent string) *metainfo.MetaInfo {
+// HasMetadata returns false while the info dictionary of a magnet link is unknown.
+func (torrent *Torrent) HasMetadata() bool {
+	return torrent.InfoBytes != ""
+}
+
+func readTorrent(torrent string) (metaInfo *metainfo.MetaInfo, err error) {
 	if strings.HasPrefix(torrent, "http:") {
-		panic("Not implemented")
-	} else if strings.HasPrefix(torrent, "magnet:") {
-		panic("Not implemented")
-	} else {
+		return nil, ErrNotImplemented
+	}
 
-		log.Debugf("Opening: %v", torrent)
+	log.Debugf("Opening: %v", torrent)
 
-		file, err := os.Open(torrent)
-		if err != nil {
-			panic(err)
-		}
+	file, err := os.Open(torrent)
+	if err != nil {
+		return
+	}
+	defer file.Close()
 
-		defer func() {
-			if err := file.Close(); err != nil {
-				panic(err)
-			}
-		}()
+	return metainfo.Read(file)
+}
 
-		metaInfo, err := metainfo.Read(file)
-		if err != nil {
-			panic(err)
+// FileEnds returns the indices of the first and the last piece of every file.
+func (torrent *Torrent) FileEnds() (pieces []int) {
+	offset := 0
+	for _, length := range torrent.FileLengths {
+		if length == 0 {
+			continue
 		}
+		pieces = append(pieces, offset/torrent.PieceLength, (offset+length-1)/torrent.PieceLength)
+		offset += length
+	}
+	return
+}
+
+// UsesDHT returns true if peers can be looked for in the DHT.
+func (torrent *Torrent) UsesDHT() bool {
+	return torrent.DHT != nil && !torrent.Private
+}
 
-		return metaInfo
+// announceDHT looks for peers in the DHT and announces that we are downloading
+// the torrent, the peer manager calls it every DHTAnnounceInterval.
+func (torrent *Torrent) announceDHT() {
+	if !torrent.UsesDHT() {
+		return
 	}
+
+	peers := torrent.DHT.Announce(torrent.InfoHash, torrent.Port)
+	log.Debugf("DHT - Found %v peers", len(peers))
+	torrent.PeerManager.UpdatePeers(peers, SourceDHT)
+}
+
+// IsBlocked returns true if the address is in the blocklist.
+func (torrent *Torrent) IsBlocked(ip net.IP) bool {
+	return torrent.IPFilter != nil && torrent.IPFilter.Blocked(ip)
+}
+
+// IsSeeding returns true once every piece has been downloaded and verified.
+func (torrent *Torrent) IsSeeding() bool {
+	return torrent.HasMetadata() && torrent.CompletedPieces.Cardinality() == torrent.PieceCount
 }
 
 func (torrent *Torrent) Test() (err error) {
-	trackerResponse, err := torrent.Tracker.Peers(
-		torrent.InfoHash,
-		torrent.ClientId,
-		torrent.Port,
-		torrent.Uploaded,
-		torrent.Downloaded,
-		torrent.Length,
-	)
-
-	log.Debugf("Len of addr: %v", len(trackerResponse.PeerAddresses))
-	torrent.PeerManager.UpdatePeers(trackerResponse.PeerAddresses)
+	if torrent.Announce != "" {
+		trackerResponse, err := torrent.Tracker.Peers(
+			torrent.InfoHash,
+			torrent.ClientId,
+			torrent.Port,
+			torrent.Uploaded,
+			torrent.Downloaded,
+			torrent.Length,
+			torrent.IPv6,
+		)
+		if err != nil {
+			if !torrent.UsesDHT() {
+				return err
+			}
+			log.Errorf("Unable to reach the tracker: %v", err)
+		} else {
+			log.Debugf("Len of addr: %v", len(trackerResponse.PeerAddresses))
+			torrent.PeerManager.UpdatePeers(trackerResponse.PeerAddresses, SourceTracker)
+		}
+	}
 
 	time.Sleep(240 * time.Second)
 
@@ -1,10 +1,8 @@
 package gotorrent
 
 import (
-	"bytes"
 	"code.google.com/p/bencode-go"
 	log "code.google.com/p/tcgl/applog"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,7 +24,9 @@ type TrackerResponse struct {
 	Complete       int
 	Incomplete     int
 	BinaryPeers    string "peers"
-	PeerAddresses  []net.TCPAddr
+	// BinaryPeers6 are the IPv6 peers, see BEP 7
+	BinaryPeers6  string "peers6"
+	PeerAddresses []net.TCPAddr
 }
 
 func NewTracker(announce string) *Tracker {
@@ -35,7 +35,9 @@ func NewTracker(announce string) *Tracker {
 	return t
 }
 
-func (tracker Tracker) Peers(infoHash string, clientId ClientId, port, uploaded, downloaded, left int) (trackerResponse *TrackerResponse, err error) {
+// Peers announces the torrent, ipv6 is our IPv6 address if known: the tracker
+// only sees the address family the request comes from.
+func (tracker Tracker) Peers(infoHash string, clientId ClientId, port, uploaded, downloaded, left int, ipv6 net.IP) (trackerResponse *TrackerResponse, err error) {
 	v := url.Values{}
 
 	v.Set("info_hash", infoHash)
@@ -45,6 +47,9 @@ func (tracker Tracker) Peers(infoHash string, clientId ClientId, port, uploaded,
 	v.Add("downloaded", strconv.FormatInt(int64(downloaded), 10))
 	v.Add("left", strconv.FormatInt(int64(left), 10))
 	v.Add("compact", strconv.FormatInt(1, 10))
+	if ipv6 != nil {
+		v.Add("ipv6", ipv6.String())
+	}
 
 	query := v.Encode()
 	uri := tracker.Announce + "?" + query
@@ -75,39 +80,8 @@ func (tracker Tracker) Peers(infoHash string, clientId ClientId, port, uploaded,
 	if err != nil {
 		return
 	}
-	trackerResponse.PeerAddresses, err = parsePeerAddresses(trackerResponse.BinaryPeers)
-
-	if err != nil {
-		return
-	}
-
-	return
-}
-
-// binaryPeers is a string consisting of multiples of 6 bytes.
-// First 4 bytes are the IP address and last 2 bytes are the port number.
-// All in network (big endian) notation.
-func parsePeerAddresses(binaryPeers string) (peers []net.TCPAddr, err error) {
-	peersCount := len(binaryPeers) / 6
-	peers = make([]net.TCPAddr, peersCount, peersCount)
-
-	for i := 0; i < len(binaryPeers); i += 6 {
-		peer := binaryPeers[i : i+6]
-
-		ip := net.IPv4(
-			peer[0],
-			peer[1],
-			peer[2],
-			peer[3])
-
-		var port uint16
-		err = binary.Read(bytes.NewBufferString(peer[4:]), binary.BigEndian, &port)
-		if err != nil {
-			return
-		}
-
-		peers[i/6] = net.TCPAddr{ip, int(port), ""}
-	}
-
+	trackerResponse.PeerAddresses = append(
+		parseCompactPeers(trackerResponse.BinaryPeers, net.IPv4len),
+		parseCompactPeers(trackerResponse.BinaryPeers6, net.IPv6len)...)
 	return
 }
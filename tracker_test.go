@@ -0,0 +1,43 @@
+package gotorrent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrackerPeers(t *testing.T) {
+	ipv4 := net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	ipv6 := net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}
+	ourIPv6 := net.ParseIP("2001:db8::42")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value := r.URL.Query().Get("ipv6"); value != ourIPv6.String() {
+			t.Errorf("ipv6 == %v, want %v", value, ourIPv6)
+		}
+
+		response, _ := encodeDict(map[string]interface{}{
+			"interval": 1800,
+			"peers":    compactPeer(ipv4),
+			"peers6":   compactPeer(ipv6),
+		})
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	response, err := NewTracker(server.URL).Peers("abcdefghij0123456789", NewClientId(), 6881, 0, 0, 0, ourIPv6)
+	if err != nil {
+		t.Fatalf("Peers() returned %v", err)
+	}
+
+	expected := []string{ipv4.String(), ipv6.String()}
+	if len(response.PeerAddresses) != len(expected) {
+		t.Fatalf("PeerAddresses == %v, want %v", response.PeerAddresses, expected)
+	}
+	for i, addr := range response.PeerAddresses {
+		if value := addr.String(); value != expected[i] {
+			t.Errorf("PeerAddresses[%v] == %v, want %v", i, value, expected[i])
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxPayloadSize keeps the packets below the usual path MTU
+	MaxPayloadSize = 1380
+	// MaxReceiveBuffer is the window we advertise
+	MaxReceiveBuffer = 1024 * 1024
+	// MaxTransmissions is the number of times a packet is sent before giving up
+	MaxTransmissions = 6
+	// CloseTimeout bounds the time spent delivering the outstanding data after Close
+	CloseTimeout = 5 * time.Second
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// maxReorder is how far ahead of the next expected packet we buffer
+	maxReorder             = 1024
+	duplicateAcksForResend = 3
+)
+
+// LEDBAT congestion control
+const (
+	// TargetDelay is the queuing delay LEDBAT aims at
+	TargetDelay = 100 * time.Millisecond
+	// maxWindowIncrease is the growth of the window per round trip when there's no queuing delay
+	maxWindowIncrease = 3000
+	minWindow         = MaxPayloadSize
+	// baseDelayWindow is how long a delay sample is considered for the base delay
+	baseDelayWindow = time.Minute
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+// Conn is a uTP connection.
+type Conn struct {
+	socket     *Socket
+	remote     *net.UDPAddr
+	recvId     uint16
+	sendId     uint16
+	ownsSocket bool
+
+	lock    sync.Mutex
+	changed chan struct{}
+	state   int
+	err     error
+	// lingerDeadline is when a closed connection gives up on its outstanding data
+	lingerDeadline time.Time
+
+	// seqNr is the sequence number of the next packet, ackNr the last one received in order
+	seqNr uint16
+	ackNr uint16
+
+	// Packets sent and not acknowledged yet, oldest first
+	outbound   []*outPacket
+	inflight   int
+	maxWindow  float64
+	peerWindow int
+	lastAckNr  uint16
+	dupAcks    int
+
+	rtt     time.Duration
+	rttVar  time.Duration
+	timeout time.Duration
+
+	// replyMicro is the one way delay of the last packet received, sent back to the peer
+	replyMicro uint32
+	delays     delayHistory
+
+	readBuffer bytes.Buffer
+	reorder    map[uint16]*inPacket
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type outPacket struct {
+	header        header
+	payload       []byte
+	sent          time.Time
+	transmissions int
+}
+
+type inPacket struct {
+	payload []byte
+	fin     bool
+}
+
+func newConn(socket *Socket, remote *net.UDPAddr, recvId, sendId uint16) *Conn {
+	c := new(Conn)
+	c.socket = socket
+	c.remote = remote
+	c.recvId = recvId
+	c.sendId = sendId
+	c.changed = make(chan struct{})
+	c.maxWindow = minWindow
+	c.peerWindow = MaxReceiveBuffer
+	c.timeout = initialTimeout
+	c.reorder = make(map[uint16]*inPacket)
+	return c
+}
+
+// connect sends the SYN and waits for its acknowledgment.
+func (c *Conn) connect(deadline time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.state = stateSynSent
+	c.seqNr = 1
+	// The SYN carries our receive id, the other packets our send id
+	c.sendPacket(&outPacket{header: header{typ: stSyn, connId: c.recvId}})
+
+	for c.state == stateSynSent && c.err == nil {
+		if !c.wait(deadline) {
+			c.fail(ErrTimeout)
+		}
+	}
+	return c.err
+}
+
+// accepted answers the SYN of a connecting peer.
+func (c *Conn) accepted(syn header) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := make([]byte, 2)
+	rand.Read(id)
+	c.seqNr = binary.BigEndian.Uint16(id)
+	c.ackNr = syn.seqNr
+	c.lastAckNr = c.seqNr - 1
+	c.state = stateConnected
+	c.sendState()
+}
+
+func (c *Conn) handlePacket(h header, payload []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.notify()
+
+	if c.state == stateClosed {
+		return
+	}
+	if h.typ == stReset {
+		c.fail(ErrConnectionReset)
+		return
+	}
+
+	now := time.Now()
+	c.peerWindow = int(h.wndSize)
+	c.replyMicro = nowMicros() - h.timestamp
+
+	if c.state == stateSynSent && h.typ == stState {
+		// The first data packet of the peer will have the sequence number of its SYN-ACK
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+
+	c.processAck(h, now)
+
+	switch h.typ {
+	case stData, stFin:
+		c.receive(h.seqNr, payload, h.typ == stFin)
+		c.sendState()
+	case stSyn:
+		// Our SYN-ACK has been lost
+		c.sendState()
+	}
+
+	if c.state == stateFinSent && len(c.outbound) == 0 {
+		c.close()
+	}
+}
+
+// processAck removes the acknowledged packets, it feeds the round trip time
+// estimator and the congestion control.
+func (c *Conn) processAck(h header, now time.Time) {
+	acked := 0
+	for len(c.outbound) > 0 && !seqLess(h.ackNr, c.outbound[0].header.seqNr) {
+		p := c.outbound[0]
+		c.outbound = c.outbound[1:]
+		c.inflight -= len(p.payload)
+		acked += len(p.payload)
+
+		// Karn's algorithm, retransmitted packets give ambiguous samples
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sent))
+		}
+	}
+
+	if acked > 0 || (len(c.outbound) == 0 && h.ackNr != c.lastAckNr) {
+		c.dupAcks = 0
+		if acked > 0 && h.timestampDiff != 0 {
+			c.updateWindow(acked, time.Duration(h.timestampDiff)*time.Microsecond, now)
+		}
+	} else if h.typ == stState && h.ackNr == c.lastAckNr && len(c.outbound) > 0 {
+		c.dupAcks++
+		if c.dupAcks == duplicateAcksForResend {
+			// Fast retransmit, the peer is missing the next packet
+			c.maxWindow = maxFloat(c.maxWindow/2, minWindow)
+			c.sendPacket(c.outbound[0])
+		}
+	}
+	c.lastAckNr = h.ackNr
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.timeout = c.rtt + 4*c.rttVar
+	if c.timeout < minTimeout {
+		c.timeout = minTimeout
+	}
+}
+
+// updateWindow is the LEDBAT controller: the window grows while the queuing
+// delay is below TargetDelay, and shrinks when it's above.
+func (c *Conn) updateWindow(acked int, delay time.Duration, now time.Time) {
+	c.delays.add(delay, now)
+	queuingDelay := delay - c.delays.base()
+
+	offTarget := float64(TargetDelay-queuingDelay) / float64(TargetDelay)
+	windowFactor := minFloat(float64(acked), c.maxWindow) / maxFloat(c.maxWindow, float64(acked))
+	c.maxWindow = maxFloat(c.maxWindow+maxWindowIncrease*offTarget*windowFactor, minWindow)
+}
+
+func (c *Conn) receive(seqNr uint16, payload []byte, fin bool) {
+	if c.eof {
+		return
+	}
+
+	if seqNr != c.ackNr+1 {
+		if seqLess(c.ackNr, seqNr) && seqNr-c.ackNr < maxReorder {
+			c.reorder[seqNr] = &inPacket{payload, fin}
+		}
+		return
+	}
+
+	c.deliver(payload, fin)
+	for !c.eof {
+		p, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.deliver(p.payload, p.fin)
+	}
+}
+
+func (c *Conn) deliver(payload []byte, fin bool) {
+	c.ackNr++
+	c.readBuffer.Write(payload)
+	if fin {
+		c.eof = true
+		c.reorder = nil
+	}
+}
+
+// tick retransmits the oldest packet when it hasn't been acknowledged in time,
+// and releases a closed connection whose data couldn't be delivered.
+func (c *Conn) tick(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == stateFinSent && !now.Before(c.lingerDeadline) {
+		c.close()
+		return
+	}
+	if len(c.outbound) == 0 || now.Sub(c.outbound[0].sent) < c.timeout {
+		return
+	}
+
+	p := c.outbound[0]
+	if p.transmissions >= MaxTransmissions {
+		c.fail(ErrTimeout)
+		return
+	}
+
+	c.timeout *= 2
+	if c.timeout > maxTimeout {
+		c.timeout = maxTimeout
+	}
+	c.maxWindow = minWindow
+	c.sendPacket(p)
+}
+
+// sendPacket sends a packet which consumes a sequence number, it's kept until acknowledged.
+func (c *Conn) sendPacket(p *outPacket) {
+	if p.transmissions == 0 {
+		p.header.seqNr = c.seqNr
+		c.seqNr++
+		c.outbound = append(c.outbound, p)
+		c.inflight += len(p.payload)
+	}
+	p.transmissions++
+	p.sent = time.Now()
+	c.send(&p.header, p.payload)
+}
+
+// sendState acknowledges the packets received so far.
+func (c *Conn) sendState() {
+	h := header{typ: stState, connId: c.sendId, seqNr: c.seqNr}
+	c.send(&h, nil)
+}
+
+func (c *Conn) send(h *header, payload []byte) {
+	h.timestamp = nowMicros()
+	h.timestampDiff = c.replyMicro
+	h.ackNr = c.ackNr
+	if window := MaxReceiveBuffer - c.readBuffer.Len(); window > 0 {
+		h.wndSize = uint32(window)
+	} else {
+		h.wndSize = 0
+	}
+	c.socket.send(c.remote, h, payload)
+}
+
+func (c *Conn) window() int {
+	window := int(c.maxWindow)
+	if c.peerWindow < window {
+		window = c.peerWindow
+	}
+	return window
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.readBuffer.Len() == 0 {
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.state == stateFinSent:
+			return 0, ErrClosed
+		}
+		if !c.wait(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+	}
+
+	wasFull := c.readBuffer.Len() >= MaxReceiveBuffer/2
+	n, _ = c.readBuffer.Read(b)
+	if wasFull && c.state != stateClosed {
+		// Tell the peer that the window has opened again
+		c.sendState()
+	}
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(b) > 0 {
+		size := len(b)
+		if size > MaxPayloadSize {
+			size = MaxPayloadSize
+		}
+
+		// At least one packet is always allowed in flight
+		for c.err == nil && c.state == stateConnected && c.inflight > 0 && c.inflight+size > c.window() {
+			if !c.wait(c.writeDeadline) {
+				return n, timeoutError{}
+			}
+		}
+		if c.err != nil {
+			return n, c.err
+		}
+		if c.state != stateConnected {
+			return n, ErrClosed
+		}
+
+		payload := append([]byte(nil), b[:size]...)
+		c.sendPacket(&outPacket{header: header{typ: stData, connId: c.sendId}, payload: payload})
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Close sends a FIN and returns, the outstanding data is delivered in the background
+// until it's acknowledged or CloseTimeout expires.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != stateConnected || c.err != nil {
+		c.close()
+		return nil
+	}
+
+	c.sendPacket(&outPacket{header: header{typ: stFin, connId: c.sendId}})
+	c.state = stateFinSent
+	c.lingerDeadline = time.Now().Add(CloseTimeout)
+	c.notify()
+	return nil
+}
+
+// close releases the connection without notifying the peer.
+func (c *Conn) close() {
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	c.notify()
+
+	c.socket.remove(c)
+	if c.ownsSocket {
+		go c.socket.Close()
+	}
+}
+
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.close()
+}
+
+// reset is called when the socket is closed.
+func (c *Conn) reset(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.fail(err)
+}
+
+// wait releases the lock until the connection changes, it returns false if the deadline expires.
+func (c *Conn) wait(deadline time.Time) bool {
+	changed := c.changed
+	c.lock.Unlock()
+	defer c.lock.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return true
+	}
+
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// timeoutError is returned when a deadline expires, it's a net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// delayHistory keeps the minimum one way delay of the last two minutes,
+// which is taken as the delay of an empty queue.
+type delayHistory struct {
+	current  time.Duration
+	previous time.Duration
+	started  time.Time
+}
+
+func (d *delayHistory) add(delay time.Duration, now time.Time) {
+	if d.started.IsZero() || now.Sub(d.started) > baseDelayWindow {
+		d.previous = d.current
+		d.current = delay
+		d.started = now
+	} else if delay < d.current {
+		d.current = delay
+	}
+}
+
+func (d *delayHistory) base() time.Duration {
+	if d.previous != 0 && d.previous < d.current {
+		return d.previous
+	}
+	return d.current
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
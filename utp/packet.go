@@ -0,0 +1,91 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version      = 1
+	headerLength = 20
+)
+
+var ErrInvalidPacket = errors.New("Invalid uTP packet")
+
+// header is the uTP header, all fields are in network byte order:
+// type and version, extension, connection_id, timestamp_microseconds,
+// timestamp_difference_microseconds, wnd_size, seq_nr, ack_nr.
+type header struct {
+	typ           byte
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	data := make([]byte, headerLength+len(payload))
+	data[0] = h.typ<<4 | version
+	// No extension, selective acks aren't sent
+	data[1] = 0
+	binary.BigEndian.PutUint16(data[2:], h.connId)
+	binary.BigEndian.PutUint32(data[4:], h.timestamp)
+	binary.BigEndian.PutUint32(data[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(data[12:], h.wndSize)
+	binary.BigEndian.PutUint16(data[16:], h.seqNr)
+	binary.BigEndian.PutUint16(data[18:], h.ackNr)
+	copy(data[headerLength:], payload)
+	return data
+}
+
+// parsePacket decodes a packet, the extensions are skipped.
+func parsePacket(data []byte) (h header, payload []byte, err error) {
+	if len(data) < headerLength || data[0]&0x0F != version || data[0]>>4 > stSyn {
+		err = ErrInvalidPacket
+		return
+	}
+
+	h.typ = data[0] >> 4
+	h.connId = binary.BigEndian.Uint16(data[2:])
+	h.timestamp = binary.BigEndian.Uint32(data[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(data[8:])
+	h.wndSize = binary.BigEndian.Uint32(data[12:])
+	h.seqNr = binary.BigEndian.Uint16(data[16:])
+	h.ackNr = binary.BigEndian.Uint16(data[18:])
+
+	// Every extension starts with the type of the next one and its length
+	extension := data[1]
+	payload = data[headerLength:]
+	for extension != 0 {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			err = ErrInvalidPacket
+			return
+		}
+		extension = payload[0]
+		payload = payload[2+int(payload[1]):]
+	}
+	return
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+var epoch = time.Now()
+
+func nowMicros() uint32 {
+	return uint32(time.Since(epoch) / time.Microsecond)
+}
@@ -0,0 +1,246 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+// stream over UDP whose LEDBAT congestion control yields to other traffic.
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// AcceptBacklog is the number of connections waiting to be accepted
+	AcceptBacklog = 32
+	// tickInterval is how often the connections check their timeouts
+	tickInterval  = 100 * time.Millisecond
+	maxPacketSize = 65535
+)
+
+var (
+	ErrClosed          = errors.New("Connection closed")
+	ErrConnectionReset = errors.New("Connection reset by peer")
+	ErrTimeout         = errors.New("Connection timed out")
+)
+
+type connKey struct {
+	addr   string
+	recvId uint16
+}
+
+// Socket is a UDP socket multiplexing uTP connections, it's a net.Listener
+// when it has been created by Listen.
+type Socket struct {
+	conn   *net.UDPConn
+	conns  map[connKey]*Conn
+	lock   sync.Mutex
+	accept chan *Conn
+
+	// dropPacket can simulate a lossy link in tests
+	dropPacket func(h *header) bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSocket(network, addr string) (s *Socket, err error) {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return
+	}
+
+	s = new(Socket)
+	if s.conn, err = net.ListenUDP(network, udpAddr); err != nil {
+		return nil, err
+	}
+	s.conns = make(map[connKey]*Conn)
+	s.done = make(chan struct{})
+	return
+}
+
+func (s *Socket) start() {
+	go s.read()
+	go s.tick()
+}
+
+// Listen accepts uTP connections on a UDP address, the socket can also dial.
+// The network is "udp", "udp4" or "udp6" as for net.ListenUDP.
+func Listen(network, addr string) (s *Socket, err error) {
+	if s, err = newSocket(network, addr); err != nil {
+		return
+	}
+	s.accept = make(chan *Conn, AcceptBacklog)
+	s.start()
+	return
+}
+
+// DialTimeout connects from a new socket, which is closed with the connection.
+func DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	s, err := newSocket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s.start()
+
+	c, err := s.DialTimeout(addr, timeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	c.ownsSocket = true
+	return c, nil
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close resets the connections and closes the socket.
+func (s *Socket) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.lock.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.lock.Unlock()
+
+		for _, c := range conns {
+			c.reset(ErrClosed)
+		}
+		err = s.conn.Close()
+	})
+	return
+}
+
+// DialTimeout connects to a uTP peer from this socket.
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (c *Conn, err error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	var recvId uint16
+	for {
+		id := make([]byte, 2)
+		rand.Read(id)
+		recvId = binary.BigEndian.Uint16(id)
+		if _, ok := s.conns[connKey{remote.String(), recvId}]; !ok {
+			break
+		}
+	}
+	c = newConn(s, remote, recvId, recvId+1)
+	s.conns[connKey{remote.String(), recvId}] = c
+	s.lock.Unlock()
+
+	if err = c.connect(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *Socket) send(remote *net.UDPAddr, h *header, payload []byte) {
+	if s.dropPacket != nil && s.dropPacket(h) {
+		return
+	}
+	s.conn.WriteToUDP(h.marshal(payload), remote)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := connKey{c.remote.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) read() {
+	buffer := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			s.Close()
+			return
+		}
+
+		h, payload, err := parsePacket(buffer[:n])
+		if err != nil {
+			continue
+		}
+		// The payload is kept by the connection
+		payload = append([]byte(nil), payload...)
+
+		recvId := h.connId
+		if h.typ == stSyn {
+			recvId = h.connId + 1
+		}
+
+		s.lock.Lock()
+		c, ok := s.conns[connKey{addr.String(), recvId}]
+		if !ok && h.typ == stReset {
+			// A reset carries either of our connection ids
+			for _, id := range []uint16{h.connId - 1, h.connId + 1} {
+				if other, found := s.conns[connKey{addr.String(), id}]; found && other.sendId == h.connId {
+					c, ok = other, true
+				}
+			}
+		}
+		if !ok && h.typ == stSyn && s.accept != nil {
+			c = newConn(s, addr, recvId, h.connId)
+			if len(s.accept) < cap(s.accept) {
+				c.accepted(h)
+				s.conns[connKey{addr.String(), recvId}] = c
+				s.accept <- c
+			} else {
+				c = nil
+			}
+			ok = false
+		}
+		s.lock.Unlock()
+
+		if ok {
+			c.handlePacket(h, payload)
+		} else if c == nil && h.typ != stReset {
+			s.send(addr, &header{typ: stReset, connId: h.connId, timestamp: nowMicros(), ackNr: h.seqNr}, nil)
+		}
+	}
+}
+
+func (s *Socket) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.lock.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.lock.Unlock()
+
+			for _, c := range conns {
+				c.tick(now)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
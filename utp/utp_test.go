@@ -0,0 +1,169 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacket(t *testing.T) {
+	h := header{typ: stData, connId: 1234, timestamp: 5, timestampDiff: 6, wndSize: 7, seqNr: 65535, ackNr: 9}
+	data := h.marshal([]byte("payload"))
+
+	value, payload, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("parsePacket() returned %v", err)
+	}
+	if value != h {
+		t.Errorf("parsePacket() == %+v, want %+v", value, h)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("parsePacket() payload == %q, want %q", payload, "payload")
+	}
+
+	if !seqLess(65535, 0) || seqLess(0, 65535) {
+		t.Errorf("seqLess() doesn't wrap around")
+	}
+}
+
+// transfer sends data in both directions between a dialed and an accepted connection,
+// the accepted one loses the first transmission of every dropEvery-th data packet.
+func transfer(t *testing.T, dropEvery int) {
+	listener, err := newSocket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	listener.accept = make(chan *Conn, AcceptBacklog)
+	var lock sync.Mutex
+	sent := make(map[uint16]bool)
+	dropped := 0
+	if dropEvery > 0 {
+		listener.dropPacket = func(h *header) bool {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if h.typ != stData || sent[h.seqNr] {
+				return false
+			}
+			sent[h.seqNr] = true
+			if len(sent)%dropEvery != 0 {
+				return false
+			}
+			dropped++
+			return true
+		}
+	}
+	listener.start()
+
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+
+	accepted := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+
+		received, err := ioutil.ReadAll(io.LimitReader(conn, int64(len(data))))
+		if err == nil && !bytes.Equal(received, data) {
+			t.Errorf("Accepted connection received %v bytes, want the %v bytes sent", len(received), len(data))
+		}
+		_, err = conn.Write(data)
+		accepted <- err
+	}()
+
+	conn, err := DialTimeout(listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout() returned %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("conn.Write() returned %v", err)
+	}
+
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("conn.Read() returned %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Dialed connection received different data")
+	}
+
+	if err := <-accepted; err != nil {
+		t.Errorf("Accepted connection returned %v", err)
+	}
+
+	// The accepted connection has been closed
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("conn.Read() returned %v, want %v", err, io.EOF)
+	}
+
+	if dropEvery > 0 {
+		lock.Lock()
+		defer lock.Unlock()
+		if expected := len(sent) / dropEvery; dropped == 0 || dropped != expected {
+			t.Errorf("%v packets dropped, want %v", dropped, expected)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	transfer(t, 0)
+}
+
+func TestLossyTransfer(t *testing.T) {
+	transfer(t, 20)
+}
+
+func TestDialRefused(t *testing.T) {
+	// A socket which doesn't listen resets the connections
+	s, err := newSocket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.start()
+
+	if _, err := DialTimeout(s.Addr().String(), 2*time.Second); err != ErrConnectionReset {
+		t.Errorf("DialTimeout() returned %v, want %v", err, ErrConnectionReset)
+	}
+}
+
+func TestCloseLinger(t *testing.T) {
+	listener, err := newSocket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.accept = make(chan *Conn, AcceptBacklog)
+	listener.start()
+
+	conn, err := DialTimeout(listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout() returned %v", err)
+	}
+	// The FIN is never acknowledged
+	listener.Close()
+
+	start := time.Now()
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > CloseTimeout/2 {
+		t.Errorf("conn.Close() blocked for %v", elapsed)
+	}
+	if _, err := conn.Write([]byte{0}); err != ErrClosed {
+		t.Errorf("conn.Write() returned %v, want %v", err, ErrClosed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != ErrClosed {
+		t.Errorf("conn.Read() returned %v, want %v", err, ErrClosed)
+	}
+}